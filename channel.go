@@ -0,0 +1,205 @@
+package rgors
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// channels
+// Value of DTChannel is chan LObj, so Go code can share it with scripts.
+// blocking operations stop when Run of the VM is canceled.
+// receiving from a closed channel returns the eof object.
+
+var channelType = reflect.TypeOf(make(chan LObj))
+
+func NewChannel(ch chan LObj) LObj {
+	return LObj{Type: DTChannel, Value: ch}
+}
+
+// send v to ch, error if ch is closed
+func channelSend(vm *VM, ch chan LObj, v LObj) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("channel-send: closed channel")
+		}
+	}()
+	select {
+	case ch <- v:
+		return nil
+	case <-vm.Context().Done():
+		return vm.Context().Err()
+	}
+}
+
+// (channel-select clause ...) is compiled as
+// ((lambda (sel) ((car sel) (cdr sel))) (%channel-select tag arg ... handler ...))
+// %channel-select returns the handler of the ready clause with its value.
+// car, cdr and %channel-select are the primitives, not the global bindings.
+// clause is
+//
+//	(receive ch var body ...)
+//	(send ch expr body ...)
+//	(timeout seconds body ...)
+//	(else body ...)
+func (x *LObj) expandSelect() (LObj, error) {
+	lambda := *NewSymbol("lambda")
+	sel := *NewSymbol("channel-select result") // not readable
+	args := []LObj{primitiveRef("%channel-select")}
+	for elem := x.Cdr; !elem.IsNull(); elem = elem.Cdr {
+		if !elem.IsPair() || !elem.Car.IsPair() {
+			return LispFalse, fmt.Errorf("channel-select: bad syntax: %v", x)
+		}
+		clause := *elem.Car
+		operands, ok := selectOperands[clause.Car.String()]
+		if clause.Car.String() == "receive" {
+			operands++ // variable
+		}
+		if n, err := clause.Length(); !ok || err != nil || n < operands+2 {
+			return LispFalse, fmt.Errorf("channel-select: bad clause: %v", clause)
+		}
+		args = append(args, NewList(*NewSymbol("quote"), *clause.Car))
+		variable := *NewSymbol("channel-select value")
+		body := clause.Cdr
+		if clause.Car.String() == "receive" { // (receive ch var body ...)
+			if variable = *body.Cdr.Car; !variable.IsSymbol() {
+				return LispFalse, fmt.Errorf("channel-select: bad clause: %v", clause)
+			}
+			args = append(args, *body.Car)
+			body = body.Cdr.Cdr
+		} else {
+			for i := 0; i < operands; i++ {
+				args = append(args, *body.Car)
+				body = body.Cdr
+			}
+		}
+		args = append(args, Cons(lambda, Cons(NewList(variable), *body)))
+	}
+	dispatch := NewList(lambda, NewList(sel),
+		NewList(NewList(primitiveRef("car"), sel), NewList(primitiveRef("cdr"), sel)))
+	return NewList(dispatch, NewList(args...)), nil
+}
+
+// number of arguments before handler of each clause of %channel-select
+var selectOperands = map[string]int{"receive": 1, "send": 2, "timeout": 1, "else": 0}
+
+func init() {
+	DefinePrimitive("make-channel", 0, 1, func(args ...LObj) (LObj, error) {
+		size := 0
+		if len(args) > 0 {
+			n, ok := args[0].Value.(int)
+			if !args[0].IsNumber() || !ok || n < 0 {
+				return LispFalse, fmt.Errorf("make-channel: bad capacity: %v", args[0])
+			}
+			size = n
+		}
+		return NewChannel(make(chan LObj, size)), nil
+	})
+	DefinePrimitive("channel?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Type == DTChannel), nil
+	})
+	DefineVMPrimitive("channel-send", 2, 2, func(vm *VM, args ...LObj) (LObj, error) {
+		if args[0].Type != DTChannel {
+			return LispFalse, fmt.Errorf("channel-send: not channel: %v", args[0])
+		}
+		return LispNull, channelSend(vm, args[0].Value.(chan LObj), args[1])
+	})
+	// (channel-receive ch [timeout [timeout-val]])
+	DefineVMPrimitive("channel-receive", 1, 3, func(vm *VM, args ...LObj) (LObj, error) {
+		if args[0].Type != DTChannel {
+			return LispFalse, fmt.Errorf("channel-receive: not channel: %v", args[0])
+		}
+		timer, stop, err := timeoutArg("channel-receive", args, 1)
+		if err != nil {
+			return LispFalse, err
+		}
+		defer stop()
+		select {
+		case v, ok := <-args[0].Value.(chan LObj):
+			if !ok {
+				return LispEOF, nil
+			}
+			return v, nil
+		case <-timer:
+			if len(args) > 2 {
+				return args[2], nil
+			}
+			return LispFalse, fmt.Errorf("channel-receive: timeout")
+		case <-vm.Context().Done():
+			return LispFalse, vm.Context().Err()
+		}
+	})
+	DefinePrimitive("channel-close", 1, 1, func(args ...LObj) (ret LObj, err error) {
+		if args[0].Type != DTChannel {
+			return LispFalse, fmt.Errorf("channel-close: not channel: %v", args[0])
+		}
+		defer func() {
+			if recover() != nil {
+				err = fmt.Errorf("channel-close: closed channel")
+			}
+		}()
+		close(args[0].Value.(chan LObj))
+		return LispNull, nil
+	})
+	// used by channel-select.
+	// args are receive ch handler, send ch v handler, timeout secs handler or else handler.
+	DefineVMPrimitive("%channel-select", 0, -1, func(vm *VM, args ...LObj) (ret LObj, err error) {
+		cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(vm.Context().Done())}}
+		handlers := []LObj{LispFalse}
+		var timers []func()
+		defer func() {
+			for _, stop := range timers {
+				stop()
+			}
+		}()
+		for i := 0; i < len(args); i++ {
+			tag := args[i].String()
+			operands, ok := selectOperands[tag]
+			if !ok || i+operands >= len(args) {
+				return LispFalse, fmt.Errorf("channel-select: bad clause: %v", args[i])
+			}
+			c := reflect.SelectCase{Dir: reflect.SelectRecv}
+			switch tag {
+			case "receive", "send":
+				if args[i+1].Type != DTChannel {
+					return LispFalse, fmt.Errorf("channel-select: not channel: %v", args[i+1])
+				}
+				c.Chan = reflect.ValueOf(args[i+1].Value.(chan LObj))
+				if tag == "send" {
+					c.Dir = reflect.SelectSend
+					c.Send = reflect.ValueOf(args[i+2])
+				}
+			case "timeout":
+				timer, stop, err := timeoutArg("channel-select", args, i+1)
+				if err != nil {
+					return LispFalse, err
+				}
+				timers = append(timers, stop)
+				c.Chan = reflect.ValueOf(timer)
+			case "else":
+				c.Dir = reflect.SelectDefault
+			}
+			i += operands + 1
+			cases = append(cases, c)
+			handlers = append(handlers, args[i])
+		}
+		defer func() {
+			if recover() != nil {
+				err = fmt.Errorf("channel-select: closed channel")
+			}
+		}()
+		chosen, v, ok := reflect.Select(cases)
+		if chosen == 0 {
+			return LispFalse, vm.Context().Err()
+		}
+		value := LispFalse
+		if cases[chosen].Dir == reflect.SelectRecv && cases[chosen].Chan.Type() == channelType {
+			value = LispEOF
+			if ok {
+				value = v.Interface().(LObj)
+			}
+		}
+		return Cons(handlers[chosen], value), nil
+	})
+	DefineLibrary("(rgors channel)",
+		"make-channel", "channel?", "channel-send", "channel-receive", "channel-close")
+}
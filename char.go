@@ -0,0 +1,138 @@
+package rgors
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// characters
+// Value of DTChar is rune, procedures follow the unicode package.
+
+func NewChar(r rune) LObj {
+	return LObj{Type: DTChar, Value: r}
+}
+
+func checkChars(name string, args []LObj) error {
+	for _, arg := range args {
+		if arg.Type != DTChar {
+			return fmt.Errorf("%s: not char: %v", name, arg)
+		}
+	}
+	return nil
+}
+
+// compare adjacent characters
+func compareChars(name string, fold bool, pred func(int) bool) func(args ...LObj) (LObj, error) {
+	return func(args ...LObj) (LObj, error) {
+		if err := checkChars(name, args); err != nil {
+			return LispFalse, err
+		}
+		for k := 0; k+1 < len(args); k++ {
+			x, y := args[k].Value.(rune), args[k+1].Value.(rune)
+			if fold {
+				x, y = foldRune(x), foldRune(y)
+			}
+			if !pred(compareInt(int(x), int(y))) {
+				return LispFalse, nil
+			}
+		}
+		return LispTrue, nil
+	}
+}
+
+// test character by pred
+func charPredicate(name string, pred func(rune) bool) func(args ...LObj) (LObj, error) {
+	return func(args ...LObj) (LObj, error) {
+		if err := checkChars(name, args); err != nil {
+			return LispFalse, err
+		}
+		return NewBoolean(pred(args[0].Value.(rune))), nil
+	}
+}
+
+// convert character by f
+func mapChar(name string, f func(rune) rune) func(args ...LObj) (LObj, error) {
+	return func(args ...LObj) (LObj, error) {
+		if err := checkChars(name, args); err != nil {
+			return LispFalse, err
+		}
+		return NewChar(f(args[0].Value.(rune))), nil
+	}
+}
+
+// value of decimal digit r, -1 if r is not a digit.
+// each range of unicode.Nd is a run of digits from zero.
+func digitValue(r rune) int {
+	if !unicode.IsDigit(r) {
+		return -1
+	}
+	for _, rg := range unicode.Nd.R16 {
+		if rune(rg.Lo) <= r && r <= rune(rg.Hi) {
+			return int(r-rune(rg.Lo)) % 10
+		}
+	}
+	for _, rg := range unicode.Nd.R32 {
+		if rune(rg.Lo) <= r && r <= rune(rg.Hi) {
+			return int(r-rune(rg.Lo)) % 10
+		}
+	}
+	return -1
+}
+
+func init() {
+	DefinePrimitive("char?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Type == DTChar), nil
+	})
+	DefinePrimitive("char->integer", 1, 1, func(args ...LObj) (LObj, error) {
+		if err := checkChars("char->integer", args); err != nil {
+			return LispFalse, err
+		}
+		return NewNumber(int(args[0].Value.(rune))), nil
+	})
+	DefinePrimitive("integer->char", 1, 1, func(args ...LObj) (LObj, error) {
+		n, ok := args[0].Value.(int)
+		if !args[0].IsNumber() || !ok || !utf8.ValidRune(rune(n)) || n != int(rune(n)) {
+			return LispFalse, fmt.Errorf("integer->char: not unicode scalar value: %v", args[0])
+		}
+		return NewChar(rune(n)), nil
+	})
+	for _, fold := range []bool{false, true} {
+		prefix := "char"
+		if fold {
+			prefix = "char-ci"
+		}
+		DefinePrimitive(prefix+"=?", 1, -1, compareChars(prefix+"=?", fold, func(c int) bool { return c == 0 }))
+		DefinePrimitive(prefix+"<?", 1, -1, compareChars(prefix+"<?", fold, func(c int) bool { return c < 0 }))
+		DefinePrimitive(prefix+">?", 1, -1, compareChars(prefix+">?", fold, func(c int) bool { return c > 0 }))
+		DefinePrimitive(prefix+"<=?", 1, -1, compareChars(prefix+"<=?", fold, func(c int) bool { return c <= 0 }))
+		DefinePrimitive(prefix+">=?", 1, -1, compareChars(prefix+">=?", fold, func(c int) bool { return c >= 0 }))
+	}
+	DefinePrimitive("char-alphabetic?", 1, 1, charPredicate("char-alphabetic?", unicode.IsLetter))
+	DefinePrimitive("char-numeric?", 1, 1, charPredicate("char-numeric?", unicode.IsDigit))
+	DefinePrimitive("char-whitespace?", 1, 1, charPredicate("char-whitespace?", unicode.IsSpace))
+	DefinePrimitive("char-upper-case?", 1, 1, charPredicate("char-upper-case?", unicode.IsUpper))
+	DefinePrimitive("char-lower-case?", 1, 1, charPredicate("char-lower-case?", unicode.IsLower))
+	// (digit-value char), #f if char is not a decimal digit
+	DefinePrimitive("digit-value", 1, 1, func(args ...LObj) (LObj, error) {
+		if err := checkChars("digit-value", args); err != nil {
+			return LispFalse, err
+		}
+		if d := digitValue(args[0].Value.(rune)); d >= 0 {
+			return NewNumber(d), nil
+		}
+		return LispFalse, nil
+	})
+	DefinePrimitive("char-upcase", 1, 1, mapChar("char-upcase", unicode.ToUpper))
+	DefinePrimitive("char-downcase", 1, 1, mapChar("char-downcase", unicode.ToLower))
+	DefinePrimitive("char-foldcase", 1, 1, mapChar("char-foldcase", foldRune))
+
+	DefineLibrary("(scheme base)",
+		"char?", "char->integer", "integer->char",
+		"char=?", "char<?", "char>?", "char<=?", "char>=?")
+	DefineLibrary("(scheme char)",
+		"char-ci=?", "char-ci<?", "char-ci>?", "char-ci<=?", "char-ci>=?",
+		"char-alphabetic?", "char-numeric?", "char-whitespace?",
+		"char-upper-case?", "char-lower-case?", "digit-value",
+		"char-upcase", "char-downcase", "char-foldcase")
+}
@@ -0,0 +1,216 @@
+package rgors
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Code is compiled bytecode of one lambda body or toplevel expression.
+// Ops holds opcodes followed by their operands inline.
+type Code struct {
+	Name    string    // procedure name, empty if anonymous
+	Arity   int       // number of parameters
+	Vars    LObj      // parameters
+	Free    LObj      // captured variables
+	Ops     []int     // opcodes and operands
+	Consts  []LObj    // constant pool
+	Globals []*Global // global variable cells
+	Protos  []*Code   // nested lambda bodies
+
+	lines       []lineEntry  // source positions, sorted by pc
+	source      SourceMap    // used while compiling
+	environment *Environment // where globals are looked up
+}
+
+// instructions from pc have position pos
+type lineEntry struct {
+	pc  int
+	pos Position
+}
+
+// opcodes
+// n is index of local or free variable, argc is number of arguments
+// jump offsets are relative to the instruction after the operands
+const (
+	OpHalt         = iota // (halt)
+	OpReferLocal          // (refer-local n)
+	OpReferFree           // (refer-free n)
+	OpReferGlobal         // (refer-global g)
+	OpIndirect            // (indirect)
+	OpConstant            // (constant k)
+	OpClose               // (close nfree proto)
+	OpBox                 // (box n)
+	OpTest                // (test else-offset)
+	OpJump                // (jump offset)
+	OpAssignLocal         // (assign-local n)
+	OpAssignFree          // (assign-free n)
+	OpAssignGlobal        // (assign-global g)
+	OpDefine              // (define g)
+	OpConti               // (conti drop)
+	OpFrame               // (frame return-offset)
+	OpArgument            // (argument)
+	OpShift               // (shift argc drop)
+	OpApply               // (apply argc)
+	OpReturn              // (return drop)
+	OpHandler             // (handler offset)
+	OpUnhandler           // (unhandler)
+)
+
+var opstring = map[int]string{
+	OpHalt:         "halt",
+	OpReferLocal:   "refer-local",
+	OpReferFree:    "refer-free",
+	OpReferGlobal:  "refer-global",
+	OpIndirect:     "indirect",
+	OpConstant:     "constant",
+	OpClose:        "close",
+	OpBox:          "box",
+	OpTest:         "test",
+	OpJump:         "jump",
+	OpAssignLocal:  "assign-local",
+	OpAssignFree:   "assign-free",
+	OpAssignGlobal: "assign-global",
+	OpDefine:       "define",
+	OpConti:        "conti",
+	OpFrame:        "frame",
+	OpArgument:     "argument",
+	OpShift:        "shift",
+	OpApply:        "apply",
+	OpReturn:       "return",
+	OpHandler:      "handler",
+	OpUnhandler:    "unhandler",
+}
+
+// number of operands
+var opargs = map[int]int{
+	OpReferLocal:   1,
+	OpReferFree:    1,
+	OpReferGlobal:  1,
+	OpConstant:     1,
+	OpClose:        2,
+	OpBox:          1,
+	OpTest:         1,
+	OpJump:         1,
+	OpAssignLocal:  1,
+	OpAssignFree:   1,
+	OpAssignGlobal: 1,
+	OpDefine:       1,
+	OpConti:        1,
+	OpFrame:        1,
+	OpShift:        2,
+	OpApply:        1,
+	OpReturn:       1,
+	OpHandler:      1,
+}
+
+// append instruction, return position of its first operand
+func (code *Code) emit(op int, args ...int) int {
+	code.Ops = append(code.Ops, op)
+	code.Ops = append(code.Ops, args...)
+	return len(code.Ops) - len(args)
+}
+
+// set jump offset at pos to the current end of code
+func (code *Code) patch(pos int) {
+	code.Ops[pos] = len(code.Ops) - (pos + 1)
+}
+
+func (code *Code) constant(obj LObj) int {
+	code.Consts = append(code.Consts, obj)
+	return len(code.Consts) - 1
+}
+
+func (code *Code) global(sym *LObj) int {
+	g := code.environment.LookUp(sym)
+	for i, elem := range code.Globals {
+		if elem == g {
+			return i
+		}
+	}
+	code.Globals = append(code.Globals, g)
+	return len(code.Globals) - 1
+}
+
+func (code *Code) proto(body *Code) int {
+	code.Protos = append(code.Protos, body)
+	return len(code.Protos) - 1
+}
+
+// following instructions are compiled from list x
+func (code *Code) mark(x *LObj) {
+	pos, ok := code.source.Position(x)
+	if !ok {
+		return
+	}
+	pc := len(code.Ops)
+	if n := len(code.lines); n > 0 {
+		if code.lines[n-1].pos == pos {
+			return
+		}
+		if code.lines[n-1].pc == pc { // nothing emitted yet
+			code.lines[n-1].pos = pos
+			return
+		}
+	}
+	code.lines = append(code.lines, lineEntry{pc: pc, pos: pos})
+}
+
+// source position of instruction at pc
+func (code *Code) Position(pc int) (Position, bool) {
+	i := sort.Search(len(code.lines), func(i int) bool { return code.lines[i].pc > pc })
+	if i == 0 {
+		return Position{}, false
+	}
+	return code.lines[i-1].pos, true
+}
+
+// whether instruction at pc is the first one of its line
+func (code *Code) lineStart(pc int) bool {
+	i := sort.Search(len(code.lines), func(i int) bool { return code.lines[i].pc >= pc })
+	return i < len(code.lines) && code.lines[i].pc == pc
+}
+
+// disassemble one instruction at pc
+func (code *Code) Instruction(pc int) string {
+	if pc >= len(code.Ops) {
+		return "<end>"
+	}
+	op := code.Ops[pc]
+	text := opstring[op]
+	args := code.Ops[pc+1 : pc+1+opargs[op]]
+	for _, arg := range args {
+		text += fmt.Sprintf(" %d", arg)
+	}
+	switch op {
+	case OpConstant:
+		text += fmt.Sprintf("\t; %v", code.Consts[args[0]])
+	case OpReferGlobal, OpAssignGlobal, OpDefine:
+		text += fmt.Sprintf("\t; %v", *code.Globals[args[0]].Symbol)
+	case OpClose:
+		text += fmt.Sprintf("\t; %s", code.Protos[args[1]].name())
+	case OpTest, OpJump, OpFrame, OpHandler:
+		text += fmt.Sprintf("\t; -> %d", pc+2+args[0])
+	}
+	return text
+}
+
+func (code *Code) name() string {
+	if code.Name == "" {
+		return "<lambda>"
+	}
+	return code.Name
+}
+
+// disassemble
+func (code *Code) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s:\n", code.name())
+	for pc := 0; pc < len(code.Ops); pc += 1 + opargs[code.Ops[pc]] {
+		fmt.Fprintf(&b, "%4d  %s\n", pc, code.Instruction(pc))
+	}
+	for _, body := range code.Protos {
+		b.WriteString(body.String())
+	}
+	return b.String()
+}
@@ -4,164 +4,490 @@ import (
 	"fmt"
 )
 
-// check tail call
-func (next *LObj) isTail() bool {
-	return next.Car.Eq(NewSymbol("return"))
+// compile time environment is (locals . frees)
+// sets is list of variables assigned by set!, they are boxed.
+
+// kind of variable
+const (
+	LocalVar = iota
+	FreeVar
+	GlobalVar
+)
+
+// search variable, not found in env means global
+func (env *LObj) CompileLookUp(varsym *LObj) (kind, n int) {
+	if env.IsNull() { // toplevel
+		return GlobalVar, 0
+	}
+	if n = env.Car.IndexOf(varsym); n >= 0 {
+		return LocalVar, n
+	}
+	if n = env.Cdr.IndexOf(varsym); n >= 0 {
+		return FreeVar, n
+	}
+	return GlobalVar, 0
 }
 
-func (e *LObj) Extend(r LObj) LObj {
-	return Cons(r, *e)
+// position of sym in list, -1 if not found
+func (list *LObj) IndexOf(sym *LObj) int {
+	n := 0
+	for elem := list; elem.IsPair(); elem = elem.Cdr {
+		if elem.Car.Eq(sym) {
+			return n
+		}
+		n += 1
+	}
+	return -1
 }
 
-func (env *LObj) CompileLookUp(varsym *LObj) (pair LObj, err error) {
-	var rib, elt int = 0, 0
-	for {
-		if env.IsNull() {
-			return LispFalse, fmt.Errorf("unbound variable: %v", varsym)
+// set operations on symbol list
+
+func (set *LObj) SetMember(x *LObj) bool {
+	return set.IndexOf(x) >= 0
+}
+
+func (set *LObj) SetCons(x *LObj) LObj {
+	if set.SetMember(x) {
+		return *set
+	}
+	return Cons(*x, *set)
+}
+
+func (set *LObj) SetUnion(set2 LObj) LObj {
+	ret := *set
+	for elem := &set2; elem.IsPair(); elem = elem.Cdr {
+		ret = ret.SetCons(elem.Car)
+	}
+	return ret
+}
+
+func (set *LObj) SetMinus(set2 LObj) LObj {
+	ret := LispNull
+	for elem := set; elem.IsPair(); elem = elem.Cdr {
+		if !set2.SetMember(elem.Car) {
+			ret = Cons(*elem.Car, ret)
 		}
-		vars := env.Car
-		if !vars.IsPair() {
-			return *vars, fmt.Errorf("lambda vars not pair: %v", vars)
+	}
+	return ret
+}
+
+func (set *LObj) SetIntersect(set2 LObj) LObj {
+	ret := LispNull
+	for elem := set; elem.IsPair(); elem = elem.Cdr {
+		if set2.SetMember(elem.Car) {
+			ret = Cons(*elem.Car, ret)
 		}
-		for {
-			// goto next rib
-			if vars.IsNull() {
-				rib += 1
-				elt = 0
-				break
-			}
-			// found!
-			if vars.Car.Eq(varsym) {
-				return Cons(
-					LObj{Type: DTNumber, Value: rib},
-					LObj{Type: DTNumber, Value: elt}), nil
-			}
-			// next
-			vars = vars.Cdr
-			elt += 1
+	}
+	return ret
+}
+
+// free variables of x which are not in bound variables b
+func (x *LObj) FindFree(b LObj) LObj {
+	if x.IsSymbol() {
+		if b.SetMember(x) {
+			return LispNull
 		}
-		// not found in this rib
-		env = env.Cdr
+		return NewList(*x)
+	}
+	if !x.IsPair() {
+		return LispNull
+	}
+	switch x.Car.String() {
+	case "quote", "import":
+		return LispNull
+	case "lambda": // (lambda vars body ...)
+		if !x.Cdr.IsPair() {
+			return LispNull
+		}
+		return x.Cdr.Cdr.FindFreeBody(b.SetUnion(*x.Cdr.Car))
+	case "set!": // (set! var exp)
+		return x.Cdr.FindFreeBody(b)
+	case "define": // (define var exp) or (define (var . vars) body ...)
+		if !x.Cdr.IsPair() {
+			return LispNull
+		}
+		if target := x.Cdr.Car; target.IsPair() {
+			return x.Cdr.Cdr.FindFreeBody(b.SetUnion(*target.Cdr))
+		}
+		return x.Cdr.Cdr.FindFreeBody(b)
+	case "if", "call/cc":
+		return x.Cdr.FindFreeBody(b)
+	case "guard": // (guard (var clause ...) body ...)
+		handler, thunk, err := x.expandGuard()
+		if err != nil {
+			return LispNull
+		}
+		forms := NewList(handler, thunk)
+		return forms.FindFreeBody(b)
+	case "channel-select":
+		expanded, err := x.expandSelect()
+		if err != nil {
+			return LispNull
+		}
+		return expanded.FindFree(b)
+	default: // application
+		return x.FindFreeBody(b)
 	}
 }
 
-// compile to continuation passing style
-func (x *LObj) comp(next, env LObj) (LObj, error) {
-	if x.IsSymbol() { // symbol
-		pair, err := env.CompileLookUp(x)
+// free variables of each element of list
+func (list *LObj) FindFreeBody(b LObj) LObj {
+	ret := LispNull
+	for elem := list; elem.IsPair(); elem = elem.Cdr {
+		ret = ret.SetUnion(elem.Car.FindFree(b))
+	}
+	return ret
+}
+
+// variables in v which are assigned in x
+func (x *LObj) FindSets(v LObj) LObj {
+	if !x.IsPair() {
+		return LispNull
+	}
+	switch x.Car.String() {
+	case "quote", "import":
+		return LispNull
+	case "lambda": // (lambda vars body ...)
+		if !x.Cdr.IsPair() {
+			return LispNull
+		}
+		return x.Cdr.Cdr.FindSetsBody(v.SetMinus(*x.Cdr.Car))
+	case "set!": // (set! var exp)
+		ret := x.Cdr.Cdr.FindSetsBody(v)
+		if x.Cdr.IsPair() && v.SetMember(x.Cdr.Car) {
+			ret = ret.SetCons(x.Cdr.Car)
+		}
+		return ret
+	case "guard":
+		handler, thunk, err := x.expandGuard()
+		if err != nil {
+			return LispNull
+		}
+		forms := NewList(handler, thunk)
+		return forms.FindSetsBody(v)
+	case "channel-select":
+		expanded, err := x.expandSelect()
 		if err != nil {
-			return pair, err
+			return LispNull
+		}
+		return expanded.FindSets(v)
+	default:
+		return x.FindSetsBody(v)
+	}
+}
+
+// assigned variables of each element of list
+func (list *LObj) FindSetsBody(v LObj) LObj {
+	ret := LispNull
+	for elem := list; elem.IsPair(); elem = elem.Cdr {
+		ret = ret.SetUnion(elem.Car.FindSets(v))
+	}
+	return ret
+}
+
+// compile x into code, x's value is left in the accumulator.
+// tail call returns from current procedure.
+func (x *LObj) comp(code *Code, env, sets LObj, tail bool) error {
+	if x.IsSymbol() { // symbol
+		code.compRefer(x, env)
+		kind, _ := env.CompileLookUp(x)
+		if kind != GlobalVar && sets.SetMember(x) {
+			code.emit(OpIndirect)
 		}
-		return NewList(*NewSymbol("refer"), pair, next), nil
 	} else if x.IsPair() { // pair
+		code.mark(x)
 		switch x.Car.String() {
 		case "quote": // (quote obj)
 			obj, err := x.ListRef(1)
 			if err != nil {
-				return obj, err
+				return err
 			}
-			return NewList(*NewSymbol("constant"), obj, next), nil
-		case "lambda": // (lambda (var ...) body)
+			code.emit(OpConstant, code.constant(obj))
+		case "lambda": // (lambda (var ...) body ...)
 			vars, err := x.ListRef(1)
 			if err != nil {
-				return vars, err
-			}
-			body, err := x.ListRef(2)
-			if err != nil {
-				return body, err
+				return err
 			}
-			body, err = body.comp(NewList(*NewSymbol("return")), env.Extend(vars))
-			if err != nil {
-				return body, err
+			if err = code.compClose("", vars, *x.Cdr.Cdr, env, sets); err != nil {
+				return err
 			}
-			return NewList(*NewSymbol("close"), body, next), nil
 		case "if": // (if test then else)
 			test, err := x.ListRef(1)
 			if err != nil {
-				return test, err
+				return err
 			}
 			then, err := x.ListRef(2)
 			if err != nil {
-				return test, err
+				return err
 			}
 			els, err := x.ListRef(3)
 			if err != nil {
-				return els, err
+				return err
 			}
-			thenc, err := then.comp(next, env)
-			if err != nil {
-				return thenc, err
+			if err = test.comp(code, env, sets, false); err != nil {
+				return err
 			}
-			elsec, err := els.comp(next, env)
-			if err != nil {
-				return elsec, err
+			elsepos := code.emit(OpTest, 0)
+			if err = then.comp(code, env, sets, tail); err != nil {
+				return err
+			}
+			if tail { // then clause has returned
+				code.patch(elsepos)
+				return els.comp(code, env, sets, tail)
 			}
-			return test.comp(NewList(*NewSymbol("test"), thenc, elsec), env)
+			endpos := code.emit(OpJump, 0)
+			code.patch(elsepos)
+			if err = els.comp(code, env, sets, tail); err != nil {
+				return err
+			}
+			code.patch(endpos)
+			return nil
 		case "set!": // (set! var x)
 			varsym, err := x.ListRef(1)
 			if err != nil {
-				return varsym, err
+				return err
 			}
 			x, err := x.ListRef(2)
 			if err != nil {
-				return x, err
+				return err
+			}
+			if err = x.comp(code, env, sets, false); err != nil {
+				return err
+			}
+			switch kind, n := env.CompileLookUp(&varsym); kind {
+			case LocalVar:
+				code.emit(OpAssignLocal, n)
+			case FreeVar:
+				code.emit(OpAssignFree, n)
+			default:
+				code.emit(OpAssignGlobal, code.global(&varsym))
+			}
+		case "define": // (define var x) or (define (var . vars) body ...)
+			if !env.IsNull() {
+				return fmt.Errorf("define: not at toplevel: %v", x)
+			}
+			target, err := x.ListRef(1)
+			if err != nil {
+				return err
+			}
+			if target.IsPair() { // procedure
+				err = code.compClose(target.Car.String(), *target.Cdr, *x.Cdr.Cdr, env, sets)
+				if err != nil {
+					return err
+				}
+				target = *target.Car
+			} else {
+				x, err := x.ListRef(2)
+				if err != nil {
+					return err
+				}
+				if x.IsPair() && x.Car.String() == "lambda" && x.Cdr.IsPair() && target.IsSymbol() {
+					// (define var (lambda vars body ...)) names the closure
+					if err = code.compClose(target.String(), *x.Cdr.Car, *x.Cdr.Cdr, env, sets); err != nil {
+						return err
+					}
+				} else if err = x.comp(code, env, sets, false); err != nil {
+					return err
+				}
+			}
+			if !target.IsSymbol() {
+				return fmt.Errorf("define: not symbol: %v", target)
 			}
-			access, err := env.CompileLookUp(&varsym)
-			if err != nil { // not found
-				return access, err
+			code.emit(OpDefine, code.global(&target))
+		case "import": // (import library ...), done at compile time
+			if !env.IsNull() {
+				return fmt.Errorf("import: not at toplevel: %v", x)
 			}
-			return x.comp(NewList(*NewSymbol("assign"), access, next), env)
+			for elem := x.Cdr; !elem.IsNull(); elem = elem.Cdr {
+				if !elem.IsPair() || !elem.Car.IsList() {
+					return fmt.Errorf("import: bad syntax: %v", x)
+				}
+				if err := code.environment.importLibrary(elem.Car.String()); err != nil {
+					return err
+				}
+			}
+			code.emit(OpConstant, code.constant(LispNull))
 		case "call/cc": // (call/cc x)
 			x, err := x.ListRef(1) // x should be proc
 			if err != nil {
-				return x, err
+				return err
+			}
+			framepos := -1
+			if tail {
+				// continuation returns to the caller
+				code.emit(OpConti, code.Arity)
+			} else {
+				// save call frame
+				framepos = code.emit(OpFrame, 0)
+				code.emit(OpConti, 0)
+			}
+			code.emit(OpArgument)
+			if err = x.comp(code, env, sets, false); err != nil {
+				return err
+			}
+			code.compApply(1, tail)
+			if !tail {
+				// return address
+				code.patch(framepos)
 			}
-			c, err := x.comp(NewList(*NewSymbol("apply")), env)
+			return nil
+		case "guard": // (guard (var clause ...) body ...)
+			handler, thunk, err := x.expandGuard()
 			if err != nil {
-				return c, err
+				return err
 			}
-			// (conti (argument c))
-			c = NewList(*NewSymbol("conti"), NewList(*NewSymbol("argument"), c))
-			// tail call
-			if next.isTail() {
-				return c, nil
-			} else {
-				// save call frame (next is return address)
-				return NewList(*NewSymbol("frame"), next, c), nil
+			// handler returns to the same place as body
+			endpos := code.emit(OpFrame, 0)
+			handlerpos := code.emit(OpHandler, 0)
+			retpos := code.emit(OpFrame, 0)
+			if err = thunk.comp(code, env, sets, false); err != nil {
+				return err
+			}
+			code.emit(OpApply, 0)
+			code.patch(retpos)
+			code.emit(OpUnhandler)
+			code.emit(OpReturn, 0)
+			// stack is restored and accumulator is raised object
+			code.patch(handlerpos)
+			code.emit(OpArgument)
+			if err = handler.comp(code, env, sets, false); err != nil {
+				return err
+			}
+			code.emit(OpApply, 1)
+			code.patch(endpos)
+		case "channel-select": // (channel-select clause ...)
+			expanded, err := x.expandSelect()
+			if err != nil {
+				return err
 			}
+			return expanded.comp(code, env, sets, tail)
 		default:
 			// apply function
-			args := x.Cdr
-			// c's last inst is apply
-			c, err := x.Car.comp(NewList(*NewSymbol("apply")), env)
-			if err != nil {
-				return c, err
-			}
-			for {
-				if args.IsNull() {
-					if next.isTail() {
-						return c, nil
-					} else {
-						// next is return address
-						return NewList(*NewSymbol("frame"), next, c), nil
-					}
+			args := make([]LObj, 0)
+			for arg := x.Cdr; !arg.IsNull(); arg = arg.Cdr {
+				if !arg.IsPair() {
+					return fmt.Errorf("application: not list: %s", x.shortString())
 				}
-				// cons up c with argument
-				c, err = args.Car.comp(NewList(*NewSymbol("argument"), c), env)
-				if err != nil {
-					return c, err
+				args = append(args, *arg.Car)
+			}
+			framepos := -1
+			if !tail {
+				framepos = code.emit(OpFrame, 0)
+			}
+			// arguments are pushed from the last one
+			for i := len(args) - 1; i >= 0; i-- {
+				if err := args[i].comp(code, env, sets, false); err != nil {
+					return err
 				}
-				args = args.Cdr
+				code.emit(OpArgument)
+			}
+			if err := x.Car.comp(code, env, sets, false); err != nil {
+				return err
+			}
+			code.mark(x)
+			code.compApply(len(args), tail)
+			if !tail {
+				// return address is after apply
+				code.patch(framepos)
 			}
+			return nil
 		}
 	} else if x.IsSelfEvaluating() {
-		return NewList(*NewSymbol("constant"), *x, next), nil
+		code.emit(OpConstant, code.constant(*x))
 	} else {
-		return LispFalse, fmt.Errorf("not atomic: %v", x)
+		return fmt.Errorf("not atomic: %v", x)
+	}
+	if tail {
+		code.emit(OpReturn, code.Arity)
+	}
+	return nil
+}
+
+// accumulator = variable's value (box itself if boxed)
+func (code *Code) compRefer(x *LObj, env LObj) {
+	switch kind, n := env.CompileLookUp(x); kind {
+	case LocalVar:
+		code.emit(OpReferLocal, n)
+	case FreeVar:
+		code.emit(OpReferFree, n)
+	default:
+		code.emit(OpReferGlobal, code.global(x))
+	}
+}
+
+// tail call replaces current frame's arguments
+func (code *Code) compApply(argc int, tail bool) {
+	if tail && code.Arity > 0 {
+		code.emit(OpShift, argc, code.Arity)
+	}
+	code.emit(OpApply, argc)
+}
+
+// accumulator = closure of lambda
+func (code *Code) compClose(name string, vars, body LObj, env, sets LObj) error {
+	arity, err := vars.Length()
+	if err != nil {
+		return fmt.Errorf("lambda: bad vars: %v", vars)
 	}
+	if body.IsNull() {
+		return fmt.Errorf("lambda: empty body")
+	}
+	// collect free variables, globals are not captured
+	free := LispNull
+	candidates := body.FindFreeBody(vars)
+	for elem := &candidates; elem.IsPair(); elem = elem.Cdr {
+		if kind, _ := env.CompileLookUp(elem.Car); kind != GlobalVar {
+			free = Cons(*elem.Car, free)
+		}
+	}
+	nfree := 0
+	for elem := &free; elem.IsPair(); elem = elem.Cdr {
+		code.compRefer(elem.Car, env)
+		code.emit(OpArgument)
+		nfree += 1
+	}
+	// compile body
+	proto := &Code{
+		Name: name, Arity: arity, Vars: vars, Free: free,
+		source: code.source, environment: code.environment,
+	}
+	bodysets := body.FindSetsBody(vars)
+	for elem := &bodysets; elem.IsPair(); elem = elem.Cdr {
+		proto.emit(OpBox, vars.IndexOf(elem.Car))
+	}
+	bodysets = bodysets.SetUnion(sets.SetIntersect(free))
+	bodyenv := Cons(vars, free)
+	for ; !body.IsNull(); body = *body.Cdr {
+		if !body.IsPair() {
+			return fmt.Errorf("lambda: bad body: %v", body)
+		}
+		// the last expression is tail
+		if err := body.Car.comp(proto, bodyenv, bodysets, body.Cdr.IsNull()); err != nil {
+			return err
+		}
+	}
+	code.emit(OpClose, nfree, code.proto(proto))
+	return nil
+}
 
+func (x *LObj) Compile() (*Code, error) {
+	return x.CompileSource(nil)
 }
 
-func (x *LObj) Compile() (LObj, error) {
-	return x.comp(NewList(*NewSymbol("halt")), LispNull)
+// compile with source positions recorded by Parser
+func (x *LObj) CompileSource(source SourceMap) (*Code, error) {
+	return x.CompileIn(DefaultEnvironment, source)
+}
+
+// compile with globals of environment, source may be nil
+func (x *LObj) CompileIn(environment *Environment, source SourceMap) (*Code, error) {
+	code := &Code{
+		Name: "<toplevel>", Vars: LispNull, Free: LispNull,
+		source: source, environment: environment,
+	}
+	if err := x.comp(code, LispNull, LispNull, false); err != nil {
+		return nil, err
+	}
+	code.emit(OpHalt)
+	return code, nil
 }
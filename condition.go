@@ -0,0 +1,131 @@
+package rgors
+
+import (
+	"errors"
+	"fmt"
+)
+
+// conditions
+// errors in Run are raised to the innermost guard as Scheme objects.
+// Go errors become error objects, raise passes any object.
+
+// ErrorObject is made by error or from Go error
+type ErrorObject struct {
+	Message   string
+	Irritants LObj
+	Err       error // Go error it came from, nil if made by error
+}
+
+func NewErrorObject(message string, irritants LObj, err error) LObj {
+	return LObj{Type: DTError, Value: &ErrorObject{Message: message, Irritants: irritants, Err: err}}
+}
+
+func (e *ErrorObject) Error() string {
+	p := newPrinter(&e.Irritants)
+	p.b.WriteString(e.Message)
+	p.writeTail(&e.Irritants, 0)
+	return p.b.String()
+}
+
+func (e *ErrorObject) Unwrap() error {
+	return e.Err
+}
+
+// Condition is raised object as Go error
+type Condition struct {
+	Obj LObj
+}
+
+func (c *Condition) Error() string {
+	if c.Obj.Type == DTError {
+		return c.Obj.Value.(*ErrorObject).Error()
+	}
+	return fmt.Sprintf("uncaught exception: %v", c.Obj)
+}
+
+func (c *Condition) Unwrap() error {
+	if c.Obj.Type == DTError {
+		return c.Obj.Value.(*ErrorObject)
+	}
+	return nil
+}
+
+// object passed to handler for err
+func conditionObject(err error) LObj {
+	var c *Condition
+	if errors.As(err, &c) {
+		return c.Obj
+	}
+	return NewErrorObject(err.Error(), LispNull, err)
+}
+
+func init() {
+	DefinePrimitive("raise", 1, 1, func(args ...LObj) (LObj, error) {
+		return LispFalse, &Condition{Obj: args[0]}
+	})
+	DefinePrimitive("error", 1, -1, func(args ...LObj) (LObj, error) {
+		if args[0].Type != DTString {
+			return LispFalse, fmt.Errorf("error: not string: %v", args[0])
+		}
+		message := args[0].goString()
+		return LispFalse, &Condition{Obj: NewErrorObject(message, NewList(args[1:]...), nil)}
+	})
+	DefinePrimitive("error-object?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Type == DTError), nil
+	})
+	DefinePrimitive("error-object-message", 1, 1, func(args ...LObj) (LObj, error) {
+		if args[0].Type != DTError {
+			return LispFalse, fmt.Errorf("error-object-message: not error object: %v", args[0])
+		}
+		return NewString(args[0].Value.(*ErrorObject).Message), nil
+	})
+	DefinePrimitive("error-object-irritants", 1, 1, func(args ...LObj) (LObj, error) {
+		if args[0].Type != DTError {
+			return LispFalse, fmt.Errorf("error-object-irritants: not error object: %v", args[0])
+		}
+		return args[0].Value.(*ErrorObject).Irritants, nil
+	})
+	DefineLibrary("(scheme base)",
+		"raise", "error", "error-object?", "error-object-message", "error-object-irritants")
+}
+
+// (guard (var clause ...) body ...) is compiled as a call of
+// thunk (lambda () body ...) with handler
+// (lambda (var) (if test (begin expr ...) ... (raise var))),
+// raise is the primitive itself, not the global binding.
+// clause is (test expr ...) or (else expr ...)
+func (x *LObj) expandGuard() (handler, thunk LObj, err error) {
+	spec, err := x.ListRef(1)
+	if err != nil || !spec.IsPair() || !spec.Car.IsSymbol() {
+		return handler, thunk, fmt.Errorf("guard: bad syntax: %v", x)
+	}
+	body := *x.Cdr.Cdr
+	if !body.IsPair() {
+		return handler, thunk, fmt.Errorf("guard: empty body")
+	}
+	variable := *spec.Car
+	clauses := make([]LObj, 0)
+	for elem := spec.Cdr; !elem.IsNull(); elem = elem.Cdr {
+		if !elem.IsPair() || !elem.Car.IsPair() || !elem.Car.Cdr.IsPair() {
+			return handler, thunk, fmt.Errorf("guard: bad clause: %v", spec)
+		}
+		clauses = append(clauses, *elem.Car)
+	}
+	// build from the last clause
+	rest := NewList(primitiveRef("raise"), variable)
+	for i := len(clauses) - 1; i >= 0; i-- {
+		exprs := *clauses[i].Cdr
+		then := *exprs.Car
+		if !exprs.Cdr.IsNull() { // (begin expr ...)
+			then = NewList(Cons(*NewSymbol("lambda"), Cons(LispNull, exprs)))
+		}
+		if clauses[i].Car.IsSymbol() && clauses[i].Car.String() == "else" {
+			rest = then
+		} else {
+			rest = NewList(*NewSymbol("if"), *clauses[i].Car, then, rest)
+		}
+	}
+	handler = NewList(*NewSymbol("lambda"), NewList(variable), rest)
+	thunk = Cons(*NewSymbol("lambda"), Cons(LispNull, body))
+	return handler, thunk, nil
+}
@@ -0,0 +1,385 @@
+package rgors
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Debugger pauses the VM at breakpoints and reads commands.
+// set it as VM.Tracer to enable.
+type Debugger struct {
+	In  func() (string, error) // read a command line
+	Out io.Writer
+
+	breaks []Breakpoint
+	mode   int  // stepping mode
+	depth  int  // vm.base() when stepping started
+	enter  bool // pause at the first instruction of called closure
+
+	// the last line paused at, a line breakpoint hits once per entry
+	lastCode *Code
+	lastLine int
+}
+
+// stepping modes
+const (
+	debugContinue = iota // until breakpoint
+	debugStep            // next instruction
+	debugNext            // next instruction not in called procedures
+	debugFinish          // until current procedure returns
+	debugCall            // next procedure call
+)
+
+// Breakpoint is procedure name or source line
+type Breakpoint struct {
+	Proc string
+	File string // empty matches any file
+	Line int
+}
+
+func (bp Breakpoint) String() string {
+	switch {
+	case bp.Proc != "":
+		return bp.Proc
+	case bp.File != "":
+		return fmt.Sprintf("%s:%d", bp.File, bp.Line)
+	}
+	return fmt.Sprintf("line %d", bp.Line)
+}
+
+// add breakpoint, spec is procedure name, line or file:line
+func (d *Debugger) Break(spec string) error {
+	if spec == "" {
+		return fmt.Errorf("break: no procedure or line")
+	}
+	bp := Breakpoint{Proc: spec}
+	file, num := "", spec
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		file, num = spec[:i], spec[i+1:]
+	}
+	if line, err := strconv.Atoi(num); err == nil {
+		if line <= 0 {
+			return fmt.Errorf("break: bad line: %d", line)
+		}
+		bp = Breakpoint{File: file, Line: line}
+	}
+	d.breaks = append(d.breaks, bp)
+	return nil
+}
+
+// delete n th breakpoint, 1 origin
+func (d *Debugger) Delete(n int) error {
+	if n < 1 || n > len(d.breaks) {
+		return fmt.Errorf("delete: no breakpoint %d", n)
+	}
+	d.breaks = append(d.breaks[:n-1], d.breaks[n:]...)
+	return nil
+}
+
+func (d *Debugger) Breakpoints() []Breakpoint {
+	return d.breaks
+}
+
+// print breakpoints with their numbers
+func (d *Debugger) listBreaks() {
+	if len(d.breaks) == 0 {
+		fmt.Fprintln(d.Out, "no breakpoints")
+	}
+	for i, bp := range d.breaks {
+		fmt.Fprintf(d.Out, "%d: %v\n", i+1, bp)
+	}
+}
+
+// run until breakpoint
+func (d *Debugger) Continue() {
+	d.mode = debugContinue
+	d.enter = false
+}
+
+// pause at the next instruction
+func (d *Debugger) Step() {
+	d.mode = debugStep
+}
+
+func (d *Debugger) OnInstruction(op int, vm *VM) {
+	switch {
+	case d.enter:
+		d.enter = false
+		d.pause(vm, "break")
+	case d.mode == debugStep:
+		d.pause(vm, "step")
+	case d.mode == debugNext && vm.base() <= d.depth:
+		d.pause(vm, "next")
+	case d.hitLine(vm):
+		d.pause(vm, "break")
+	}
+}
+
+func (d *Debugger) OnCall(proc LObj, args []LObj, vm *VM) {
+	d.lastCode = nil
+	if d.mode == debugCall || d.hitProc(proc) {
+		if proc.IsClosure() {
+			// locals are bound at the first instruction
+			d.enter = true
+			return
+		}
+		fmt.Fprintf(d.Out, "call %v\n", Cons(proc, NewList(args...)))
+		d.pause(vm, "break")
+	}
+}
+
+func (d *Debugger) OnReturn(value LObj, vm *VM) {
+	d.lastCode = nil
+	if d.mode == debugFinish && vm.Depth() < d.depth {
+		fmt.Fprintf(d.Out, "=> %v\n", value)
+		d.pause(vm, "finish")
+	}
+}
+
+func (d *Debugger) hitProc(proc LObj) bool {
+	var name string
+	switch proc.Type {
+	case DTClosure:
+		name = proc.Value.(*Closure).Code.Name
+	case DTPrimitive:
+		name = proc.Value.(*Primitive).Name
+	default:
+		return false
+	}
+	for _, bp := range d.breaks {
+		if bp.Proc != "" && bp.Proc == name {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the instruction starts a line with breakpoint
+func (d *Debugger) hitLine(vm *VM) bool {
+	code, pc := vm.Code()
+	if len(d.breaks) == 0 || !code.lineStart(pc) {
+		return false
+	}
+	pos, _ := code.Position(pc)
+	if code == d.lastCode && pos.Line() == d.lastLine {
+		return false
+	}
+	d.lastCode, d.lastLine = code, pos.Line()
+	for _, bp := range d.breaks {
+		if bp.Line == pos.Line() && (bp.File == "" || bp.File == pos.Filename()) {
+			return true
+		}
+	}
+	return false
+}
+
+// read and do commands until execution is resumed
+func (d *Debugger) pause(vm *VM, why string) {
+	d.where(vm, why)
+	for {
+		line, err := d.In()
+		if err != nil { // no more input
+			d.Continue()
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), args[0]))
+		switch args[0] {
+		case "s", "step":
+			d.mode = debugStep
+			return
+		case "n", "next":
+			d.mode = debugNext
+			d.depth = vm.base()
+			return
+		case "f", "finish":
+			d.mode = debugFinish
+			d.depth = vm.base()
+			return
+		case "call":
+			d.mode = debugCall
+			return
+		case "c", "continue":
+			d.Continue()
+			return
+		case "bt", "backtrace":
+			for i, frame := range vm.Backtrace() {
+				fmt.Fprintf(d.Out, "#%d %v\n", i, frame)
+			}
+		case "p", "print":
+			fmt.Fprintln(d.Out, vm.Accumulator())
+		case "rib", "locals":
+			names, values := vm.Rib()
+			for i := range names {
+				fmt.Fprintf(d.Out, "%v = %v\n", names[i], values[i])
+			}
+		case "e", "eval":
+			ans, err := vm.EvalInRib(rest)
+			if err != nil {
+				fmt.Fprintln(d.Out, "error:", err)
+				continue
+			}
+			fmt.Fprintln(d.Out, ans)
+		case "b", "break":
+			if err := d.Break(rest); err != nil {
+				fmt.Fprintln(d.Out, err)
+			}
+		case "d", "delete":
+			n, _ := strconv.Atoi(rest)
+			if err := d.Delete(n); err != nil {
+				fmt.Fprintln(d.Out, err)
+			}
+		case "breaks":
+			d.listBreaks()
+		case "disasm":
+			code, pc := vm.Code()
+			d.disasm(code, pc)
+		case "h", "help":
+			fmt.Fprint(d.Out, debugHelp)
+		default:
+			fmt.Fprintf(d.Out, "unknown command: %s, try help\n", args[0])
+		}
+	}
+}
+
+const debugHelp = `step          next instruction
+next          next instruction, stepping over calls
+finish        until current procedure returns
+call          until next procedure call
+continue      until breakpoint
+backtrace     call frames
+print         the accumulator
+rib           arguments and free variables
+eval <expr>   evaluate expr with current variables
+break <proc|line|file:line>
+delete <n>
+breaks        list breakpoints
+disasm        current code
+`
+
+// print where vm is paused
+func (d *Debugger) where(vm *VM, why string) {
+	code, pc := vm.Code()
+	at := code.name()
+	if pos, ok := code.Position(pc); ok {
+		at = fmt.Sprintf("%s (%v)", at, pos)
+	}
+	fmt.Fprintf(d.Out, "[%s] %s\n%4d  %s\n", why, at, pc, code.Instruction(pc))
+}
+
+// print code with marker at pc
+func (d *Debugger) disasm(code *Code, pc int) {
+	fmt.Fprintf(d.Out, "%s:\n", code.name())
+	for i := 0; i < len(code.Ops); i += 1 + opargs[code.Ops[i]] {
+		marker := "  "
+		if i == pc {
+			marker = "=>"
+		}
+		fmt.Fprintf(d.Out, "%s%4d  %s\n", marker, i, code.Instruction(i))
+	}
+}
+
+// TraceFrame is an entry of backtrace
+type TraceFrame struct {
+	Name     string
+	Code     *Code
+	PC       int
+	Position Position // zero if unknown
+}
+
+func (frame TraceFrame) String() string {
+	if frame.Position == (Position{}) {
+		return frame.Name
+	}
+	return fmt.Sprintf("%s at %v", frame.Name, frame.Position)
+}
+
+// current procedure and its callers, innermost first
+func (vm *VM) Backtrace() []TraceFrame {
+	trace := []TraceFrame{newTraceFrame(vm.code, vm.pc)}
+	f, c := vm.f, vm.c
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		if frame.f == f && frame.c == c {
+			// pending call whose arguments are being evaluated
+			continue
+		}
+		// return address is after the call
+		trace = append(trace, newTraceFrame(frame.code, frame.pc-1))
+		f, c = frame.f, frame.c
+	}
+	return trace
+}
+
+// number of call frames saved by callers of the current procedure.
+// frames saved by the current procedure have its f and c.
+func (vm *VM) base() int {
+	n := len(vm.frames)
+	for n > 0 && vm.frames[n-1].f == vm.f && vm.frames[n-1].c == vm.c {
+		n -= 1
+	}
+	return n
+}
+
+func newTraceFrame(code *Code, pc int) TraceFrame {
+	pos, _ := code.Position(pc)
+	return TraceFrame{Name: code.name(), Code: code, PC: pc, Position: pos}
+}
+
+// names and values of current arguments and free variables.
+// boxed values are unboxed.
+func (vm *VM) Rib() (names, values []LObj) {
+	i := 0
+	for elem := &vm.code.Vars; elem.IsPair(); elem = elem.Cdr {
+		names = append(names, *elem.Car)
+		values = append(values, unbox(*vm.local(i)))
+		i += 1
+	}
+	i = 0
+	for elem := &vm.code.Free; elem.IsPair() && vm.c != nil; elem = elem.Cdr {
+		names = append(names, *elem.Car)
+		values = append(values, unbox(vm.c.Free[i]))
+		i += 1
+	}
+	return names, values
+}
+
+func unbox(obj LObj) LObj {
+	if obj.Type == DTBox {
+		return *obj.Car
+	}
+	return obj
+}
+
+// evaluate expression s with variables of current rib bound.
+// assignments to them are not reflected.
+func (vm *VM) EvalInRib(s string) (LObj, error) {
+	p := Parser{}
+	program, err := p.ParseString(s)
+	if err != nil {
+		return LispFalse, err
+	}
+	if len(program) != 1 {
+		return LispFalse, fmt.Errorf("eval: need one expression")
+	}
+	// ((lambda (var ...) expr) 'value ...)
+	names, values := vm.Rib()
+	quoted := make([]LObj, len(values))
+	for i, value := range values {
+		quoted[i] = NewList(*NewSymbol("quote"), value)
+	}
+	lambda := NewList(*NewSymbol("lambda"), NewList(names...), program[0])
+	expr := Cons(lambda, NewList(quoted...))
+	code, err := expr.CompileIn(vm.code.environment, nil)
+	if err != nil {
+		return LispFalse, err
+	}
+	eval := NewVM()
+	eval.Load(code)
+	return eval.Run()
+}
@@ -0,0 +1,220 @@
+package rgors
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// global variable, its value is read and written atomically
+// so threads can share it
+type Global struct {
+	Symbol *LObj
+	value  atomic.Value // LObj, nil until bound
+}
+
+// value of g and whether it is bound
+func (g *Global) Value() (LObj, bool) {
+	val, ok := g.value.Load().(LObj)
+	return val, ok
+}
+
+// bind g to val
+func (g *Global) Set(val LObj) {
+	g.value.Store(val)
+}
+
+// Environment is a set of global variables.
+// code compiled in an environment sees only its globals.
+// cells can be looked up and set concurrently.
+type Environment struct {
+	mu      sync.RWMutex
+	globals map[*LObj]*Global
+	sandbox bool // made by NewSandbox, see importLibrary
+}
+
+func NewEnvironment() *Environment {
+	return &Environment{globals: make(map[*LObj]*Global)}
+}
+
+// environment of the REPL and Compile, has all primitives
+var DefaultEnvironment = NewEnvironment()
+
+// return global cell of sym, create unbound one if not exist
+func (environment *Environment) LookUp(sym *LObj) *Global {
+	sym = NewSymbol(sym.Value.(string)) // interned one
+	environment.mu.RLock()
+	g, ok := environment.globals[sym]
+	environment.mu.RUnlock()
+	if ok {
+		return g
+	}
+	environment.mu.Lock()
+	defer environment.mu.Unlock()
+	if g, ok = environment.globals[sym]; !ok {
+		g = &Global{Symbol: sym}
+		environment.globals[sym] = g
+	}
+	return g
+}
+
+func (environment *Environment) Define(name string, val LObj) {
+	environment.LookUp(NewSymbol(name)).Set(val)
+}
+
+// bind exports of library
+func (environment *Environment) Import(library string) error {
+	registry.RLock()
+	defer registry.RUnlock()
+	names, ok := libraries[library]
+	if !ok {
+		return fmt.Errorf("import: unknown library: %s", library)
+	}
+	for _, name := range names {
+		environment.Define(name, primitives[name])
+	}
+	return nil
+}
+
+// bind exports of library by import in code.
+// capabilities are only given from Go, and sandboxes have only the
+// libraries they are made with, so they can be imported
+// only if they have been imported already.
+func (environment *Environment) importLibrary(library string) error {
+	if !capabilities[library] && !environment.sandbox {
+		return environment.Import(library)
+	}
+	registry.RLock()
+	defer registry.RUnlock()
+	names, ok := libraries[library]
+	if !ok {
+		return fmt.Errorf("import: unknown library: %s", library)
+	}
+	for _, name := range names {
+		val, ok := environment.LookUp(NewSymbol(name)).Value()
+		if !ok || val.Value != primitives[name].Value {
+			return fmt.Errorf("import: not allowed: %s", library)
+		}
+	}
+	return nil
+}
+
+// global cell in DefaultEnvironment
+func LookUpGlobal(sym *LObj) *Global {
+	return DefaultEnvironment.LookUp(sym)
+}
+
+func DefineGlobal(name string, val LObj) {
+	DefaultEnvironment.Define(name, val)
+}
+
+// libraries
+// primitives are registered by name, libraries export some of them.
+
+// guards primitives, libraries and foreignTypes
+var registry sync.RWMutex
+
+var primitives = make(map[string]LObj)
+
+// library name, e.g. "(scheme base)", to exported names
+var libraries = make(map[string][]string)
+
+// libraries with access outside the interpreter or its limits.
+// they are not imported into sandboxes unless named.
+var capabilities = map[string]bool{
+	"(srfi 18)":                true, // each thread has its own limits
+	"(scheme eval)":            true,
+	"(scheme file)":            true,
+	"(scheme load)":            true,
+	"(scheme process-context)": true,
+	"(scheme repl)":            true,
+}
+
+// add exports to library, names must be defined primitives
+func DefineLibrary(library string, names ...string) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, name := range names {
+		if _, ok := primitives[name]; !ok {
+			panic(fmt.Sprintf("library %s: undefined primitive: %s", library, name))
+		}
+	}
+	libraries[library] = append(libraries[library], names...)
+}
+
+// names of registered libraries, sorted
+func Libraries() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	names := make([]string, 0, len(libraries))
+	for name := range libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewSandbox makes environment with only allowed primitives.
+// allowed are primitive or library names.
+// if nothing is allowed, all libraries except capabilities are imported.
+// import in code can not add other libraries.
+func NewSandbox(allowed ...string) (*Environment, error) {
+	environment := NewEnvironment()
+	environment.sandbox = true
+	if len(allowed) == 0 {
+		for _, name := range Libraries() {
+			if !capabilities[name] {
+				environment.Import(name)
+			}
+		}
+		return environment, nil
+	}
+	for _, name := range allowed {
+		if environment.Import(name) == nil { // library
+			continue
+		}
+		registry.RLock()
+		prim, ok := primitives[name]
+		registry.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("sandbox: unknown primitive: %s", name)
+		}
+		environment.Define(name, prim)
+	}
+	return environment, nil
+}
+
+func NewEnvironmentObject(environment *Environment) LObj {
+	return LObj{Type: DTEnvironment, Value: environment}
+}
+
+func init() {
+	// (environment '(scheme base) ...)
+	// capabilities are only given from Go
+	DefinePrimitive("environment", 0, -1, func(args ...LObj) (LObj, error) {
+		environment := NewEnvironment()
+		for _, arg := range args {
+			name := arg.String()
+			if capabilities[name] {
+				return LispFalse, fmt.Errorf("environment: not allowed: %s", name)
+			}
+			if err := environment.Import(name); err != nil {
+				return LispFalse, fmt.Errorf("environment: unknown library: %s", name)
+			}
+		}
+		return NewEnvironmentObject(environment), nil
+	})
+	// runs nested in the caller, with its limits and context
+	DefineVMPrimitive("eval", 2, 2, func(vm *VM, args ...LObj) (LObj, error) {
+		if args[1].Type != DTEnvironment {
+			return LispFalse, fmt.Errorf("eval: not environment: %v", args[1])
+		}
+		code, err := args[0].CompileIn(args[1].Value.(*Environment), nil)
+		if err != nil {
+			return LispFalse, err
+		}
+		return vm.callCode(code)
+	})
+	DefineLibrary("(scheme eval)", "environment", "eval")
+}
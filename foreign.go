@@ -0,0 +1,92 @@
+package rgors
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// foreign objects
+// Go values of registered types are passed to scripts as they are.
+// scripts can only print, compare and test them with predicates.
+
+// ForeignType is a registered Go type
+type ForeignType struct {
+	Name   string // predicate is Name?
+	GoType reflect.Type
+	Print  func(v interface{}) string  // nil prints <Name>
+	Equal  func(a, b interface{}) bool // nil compares by ==
+}
+
+// Foreign is Go value with its type, Value of DTForeign
+type Foreign struct {
+	Type  *ForeignType
+	Value interface{}
+}
+
+var foreignTypes = make(map[reflect.Type]*ForeignType)
+
+// register type of sample as name, define predicate name?.
+// predicates are exported by (rgors foreign), name? must not be defined.
+func RegisterForeignType(name string, sample interface{}) (*ForeignType, error) {
+	t := reflect.TypeOf(sample)
+	if t == nil {
+		return nil, fmt.Errorf("foreign type %s: nil sample", name)
+	}
+	predicate := name + "?"
+	registry.Lock()
+	if ft, ok := foreignTypes[t]; ok {
+		registry.Unlock()
+		return nil, fmt.Errorf("foreign type %s: %v is registered as %s", name, t, ft.Name)
+	}
+	if _, ok := primitives[predicate]; ok {
+		registry.Unlock()
+		return nil, fmt.Errorf("foreign type %s: %s is defined", name, predicate)
+	}
+	ft := &ForeignType{Name: name, GoType: t}
+	foreignTypes[t] = ft
+	prim := NewPrimitive(predicate, 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Type == DTForeign && args[0].Value.(*Foreign).Type == ft), nil
+	})
+	primitives[predicate] = prim
+	libraries["(rgors foreign)"] = append(libraries["(rgors foreign)"], predicate)
+	registry.Unlock()
+	DefineGlobal(predicate, prim)
+	return ft, nil
+}
+
+// wrap value of registered type
+func NewForeign(value interface{}) (LObj, error) {
+	ft, ok := lookUpForeignType(reflect.TypeOf(value))
+	if !ok {
+		return LispFalse, fmt.Errorf("not registered foreign type: %T", value)
+	}
+	return LObj{Type: DTForeign, Value: &Foreign{Type: ft, Value: value}}, nil
+}
+
+func lookUpForeignType(t reflect.Type) (*ForeignType, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	ft, ok := foreignTypes[t]
+	return ft, ok
+}
+
+func (f *Foreign) String() string {
+	if f.Type.Print != nil {
+		return f.Type.Print(f.Value)
+	}
+	return fmt.Sprintf("<%s>", f.Type.Name)
+}
+
+// same type and equal values by hook of the type
+func (f *Foreign) Equal(other *Foreign) bool {
+	if f.Type != other.Type {
+		return false
+	}
+	if f.Type.Equal != nil {
+		return f.Type.Equal(f.Value, other.Value)
+	}
+	if !f.Type.GoType.Comparable() {
+		return f == other
+	}
+	return f.Value == other.Value
+}
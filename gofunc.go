@@ -0,0 +1,209 @@
+package rgors
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+var (
+	lobjType  = reflect.TypeOf(LObj{})
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// WrapGoFunc makes primitive from any Go function.
+// arguments are converted to parameter types, the result by FromGo.
+// fn may return a value, an error, or both; non-nil error is raised.
+func WrapGoFunc(fn interface{}) (LObj, error) {
+	return wrapGoFunc(funcName(fn), fn)
+}
+
+// short name of function, e.g. strings.ToUpper
+func funcName(fn interface{}) string {
+	rv := reflect.ValueOf(fn)
+	if rv.Kind() != reflect.Func {
+		return "<go>"
+	}
+	name := runtime.FuncForPC(rv.Pointer()).Name()
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+func wrapGoFunc(name string, fn interface{}) (LObj, error) {
+	switch f := fn.(type) {
+	case func(args ...LObj) (LObj, error):
+		return NewPrimitive(name, 0, -1, f), nil
+	case func(vm *VM, args ...LObj) (LObj, error):
+		return NewVMPrimitive(name, 0, -1, f), nil
+	}
+	rv := reflect.ValueOf(fn)
+	if rv.Kind() != reflect.Func || rv.IsNil() {
+		return LispFalse, fmt.Errorf("not function: %T", fn)
+	}
+	t := rv.Type()
+	// results are (), (value), (error) or (value, error)
+	errIndex := -1
+	if n := t.NumOut(); n > 0 && t.Out(n-1) == errorType {
+		errIndex = n - 1
+	}
+	if t.NumOut() > 2 || (t.NumOut() == 2 && errIndex != 1) {
+		return LispFalse, fmt.Errorf("%s: bad results: %v", name, t)
+	}
+	min, max := t.NumIn(), t.NumIn()
+	if t.IsVariadic() {
+		min, max = t.NumIn()-1, -1
+	}
+	return NewPrimitive(name, min, max, func(args ...LObj) (ret LObj, err error) {
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var pt reflect.Type
+			if t.IsVariadic() && i >= t.NumIn()-1 {
+				pt = t.In(t.NumIn() - 1).Elem()
+			} else {
+				pt = t.In(i)
+			}
+			v, err := goValue(arg, pt)
+			if err != nil {
+				return LispFalse, fmt.Errorf("%s: argument %d: %v", name, i+1, err)
+			}
+			in[i] = v
+		}
+		// a panic in fn is raised as error
+		defer func() {
+			if r := recover(); r != nil {
+				ret, err = LispFalse, fmt.Errorf("%s: %v", name, r)
+			}
+		}()
+		out := rv.Call(in)
+		if errIndex >= 0 && !out[errIndex].IsNil() {
+			return LispFalse, out[errIndex].Interface().(error)
+		}
+		if len(out) == 0 || errIndex == 0 {
+			return LispNull, nil
+		}
+		return FromGo(out[0].Interface())
+	}), nil
+}
+
+// convert obj to Go value of type t
+func goValue(obj LObj, t reflect.Type) (reflect.Value, error) {
+	if t == lobjType {
+		return reflect.ValueOf(obj), nil
+	}
+	if obj.Type == DTForeign {
+		v := reflect.ValueOf(obj.Value.(*Foreign).Value)
+		if !v.Type().AssignableTo(t) {
+			return reflect.Value{}, fmt.Errorf("%v is not %v", obj, t)
+		}
+		rv := reflect.New(t).Elem()
+		rv.Set(v)
+		return rv, nil
+	}
+	if t == symbolType {
+		if !obj.IsSymbol() {
+			return reflect.Value{}, fmt.Errorf("not symbol: %v", obj)
+		}
+		return reflect.ValueOf(Symbol(obj.Value.(string))), nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		if !obj.IsBoolean() {
+			return reflect.Value{}, fmt.Errorf("not boolean: %v", obj)
+		}
+		return reflect.ValueOf(obj.Value.(bool)).Convert(t), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if t.Kind() == reflect.Int32 && obj.Type == DTChar { // rune
+			return reflect.ValueOf(obj.Value.(rune)).Convert(t), nil
+		}
+		i, ok := obj.Value.(int)
+		if !obj.IsNumber() || !ok {
+			return reflect.Value{}, fmt.Errorf("not exact integer: %v", obj)
+		}
+		v := reflect.New(t).Elem()
+		if v.OverflowInt(int64(i)) {
+			return reflect.Value{}, fmt.Errorf("out of range for %v: %d", t, i)
+		}
+		v.SetInt(int64(i))
+		return v, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := obj.Value.(int)
+		if !obj.IsNumber() || !ok {
+			return reflect.Value{}, fmt.Errorf("not exact integer: %v", obj)
+		}
+		v := reflect.New(t).Elem()
+		if i < 0 || v.OverflowUint(uint64(i)) {
+			return reflect.Value{}, fmt.Errorf("out of range for %v: %d", t, i)
+		}
+		v.SetUint(uint64(i))
+		return v, nil
+	case reflect.Float32, reflect.Float64:
+		if !obj.IsNumber() {
+			return reflect.Value{}, fmt.Errorf("not number: %v", obj)
+		}
+		return reflect.ValueOf(toFloat(obj)).Convert(t), nil
+	case reflect.String:
+		if obj.Type != DTString {
+			return reflect.Value{}, fmt.Errorf("not string: %v", obj)
+		}
+		return reflect.ValueOf(obj.goString()).Convert(t), nil
+	case reflect.Slice:
+		var elems []LObj
+		switch {
+		case obj.Type == DTVector:
+			elems = obj.Value.([]LObj)
+		case obj.IsList():
+			for elem := &obj; elem.IsPair(); elem = elem.Cdr {
+				elems = append(elems, *elem.Car)
+			}
+		default:
+			return reflect.Value{}, fmt.Errorf("not list: %s", obj.shortString())
+		}
+		v := reflect.MakeSlice(t, len(elems), len(elems))
+		for i, elem := range elems {
+			ev, err := goValue(elem, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v.Index(i).Set(ev)
+		}
+		return v, nil
+	case reflect.Map: // association list
+		if !obj.IsList() {
+			return reflect.Value{}, fmt.Errorf("not list: %s", obj.shortString())
+		}
+		v := reflect.MakeMap(t)
+		for elem := &obj; elem.IsPair(); elem = elem.Cdr {
+			if !elem.Car.IsPair() {
+				return reflect.Value{}, fmt.Errorf("not association list: %v", obj)
+			}
+			key, err := goValue(*elem.Car.Car, t.Key())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			val, err := goValue(*elem.Car.Cdr, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			v.SetMapIndex(key, val)
+		}
+		return v, nil
+	case reflect.Chan: // chan LObj, <-chan LObj or chan<- LObj
+		if obj.Type == DTChannel && channelType.AssignableTo(t) {
+			v := reflect.New(t).Elem()
+			v.Set(reflect.ValueOf(obj.Value))
+			return v, nil
+		}
+	case reflect.Ptr: // *HashTable
+		if obj.Type == DTHashTable && hashTableType == t {
+			return reflect.ValueOf(obj.Value), nil
+		}
+	case reflect.Interface:
+		value := ToGo(obj)
+		if reflect.TypeOf(value).Implements(t) {
+			v := reflect.New(t).Elem()
+			v.Set(reflect.ValueOf(value))
+			return v, nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("cannot convert %v to %v", obj, t)
+}
@@ -0,0 +1,499 @@
+package rgors
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// hash tables
+// Value of DTHashTable is *HashTable. keys are compared by eq?, eqv?,
+// equal? or string=?, and hashed consistently with the comparison.
+// tables are locked, so threads can share them.
+
+const (
+	hashBasis  = 14695981039346656037
+	hashPrime  = 1099511628211
+	hashBudget = 64 // objects visited by Hash
+)
+
+var hashTableType = reflect.TypeOf(&HashTable{})
+
+func mixHash(h, x uint64) uint64 {
+	return (h ^ x) * hashPrime
+}
+
+// hash consistent with eqv?, objects compared by pointer are hashed by pointer
+func identityHash(obj *LObj) uint64 {
+	h := mixHash(hashBasis, uint64(obj.Type))
+	switch v := obj.Value.(type) {
+	case nil:
+		if obj.Car != nil { // pair or box
+			return mixHash(h, uint64(reflect.ValueOf(obj.Car).Pointer()))
+		}
+		return h
+	case bool:
+		if v {
+			return mixHash(h, 1)
+		}
+		return h
+	case int:
+		return mixHash(h, uint64(v))
+	case float64:
+		if v == 0 { // 0.0 and -0.0 are eq?
+			return h
+		}
+		return mixHash(h, math.Float64bits(v))
+	case rune:
+		return mixHash(h, uint64(v))
+	case string: // symbol
+		for i := 0; i < len(v); i++ {
+			h = mixHash(h, uint64(v[i]))
+		}
+		return h
+	case []LObj:
+		h = mixHash(h, uint64(len(v)))
+		if len(v) > 0 {
+			h = mixHash(h, uint64(reflect.ValueOf(&v[0]).Pointer()))
+		}
+		return h
+	}
+	switch rv := reflect.ValueOf(obj.Value); rv.Kind() {
+	case reflect.Ptr, reflect.Chan, reflect.Func, reflect.Map, reflect.UnsafePointer:
+		return mixHash(h, uint64(rv.Pointer()))
+	}
+	return h
+}
+
+// hash consistent with equal?, at most budget objects are visited.
+// cyclic structures which are equal? are unfolded to the same objects.
+func equalHash(obj *LObj, budget *int) uint64 {
+	h := mixHash(hashBasis, uint64(obj.Type))
+	if *budget <= 0 {
+		return h
+	}
+	*budget--
+	switch obj.Type {
+	case DTString:
+		for _, r := range obj.runes() {
+			h = mixHash(h, uint64(r))
+		}
+	case DTPair:
+		for ; obj.IsPair() && *budget > 0; obj = obj.Cdr {
+			h = mixHash(h, equalHash(obj.Car, budget))
+		}
+		if !obj.IsPair() {
+			h = mixHash(h, equalHash(obj, budget))
+		}
+	case DTVector:
+		elems := obj.Value.([]LObj)
+		h = mixHash(h, uint64(len(elems)))
+		for i := 0; i < len(elems) && *budget > 0; i++ {
+			h = mixHash(h, equalHash(&elems[i], budget))
+		}
+	case DTForeign: // compared by ForeignType.Equal
+	default:
+		h = identityHash(obj)
+	}
+	return h
+}
+
+// Hash of obj consistent with equal?: equal? objects have the same hash.
+func (obj *LObj) Hash() uint64 {
+	budget := hashBudget
+	h := equalHash(obj, &budget)
+	return h ^ h>>32
+}
+
+// key comparison and its hash
+type hashEquivalence struct {
+	same func(x, y *LObj) bool
+	hash func(obj *LObj) uint64
+}
+
+// equivalences of hash tables by name
+var hashEquivalences = map[string]hashEquivalence{
+	"eq?":      {(*LObj).Eq, identityHash},
+	"eqv?":     {(*LObj).Eqv, identityHash},
+	"equal?":   {(*LObj).Equal, (*LObj).Hash},
+	"string=?": {func(x, y *LObj) bool { return string(x.runes()) == string(y.runes()) }, (*LObj).Hash},
+}
+
+type hashEntry struct {
+	key, value LObj
+}
+
+type HashTable struct {
+	mu          sync.Mutex
+	equivalence string
+	hashEquivalence
+	buckets map[uint64][]hashEntry
+	count   int
+}
+
+// new hash table comparing keys by equivalence, one of eq?, eqv?, equal? or string=?
+func NewHashTable(equivalence string) (*HashTable, error) {
+	e, ok := hashEquivalences[equivalence]
+	if !ok {
+		return nil, fmt.Errorf("hash table: unknown equivalence: %s", equivalence)
+	}
+	return &HashTable{equivalence: equivalence, hashEquivalence: e, buckets: make(map[uint64][]hashEntry)}, nil
+}
+
+func NewHashTableObject(table *HashTable) LObj {
+	return LObj{Type: DTHashTable, Value: table}
+}
+
+func (table *HashTable) String() string {
+	return fmt.Sprintf("<hash-table %s>", table.equivalence)
+}
+
+// error if key can not be a key of table
+func (table *HashTable) checkKey(name string, key LObj) error {
+	if table.equivalence == "string=?" && key.Type != DTString {
+		return fmt.Errorf("%s: not string: %v", name, key)
+	}
+	return nil
+}
+
+// index of key in its bucket, -1 if not found
+func (table *HashTable) find(key LObj) (uint64, int) {
+	h := table.hash(&key)
+	for i := range table.buckets[h] {
+		if table.same(&table.buckets[h][i].key, &key) {
+			return h, i
+		}
+	}
+	return h, -1
+}
+
+// value of key, false if not found
+func (table *HashTable) Ref(key LObj) (LObj, bool) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	h, i := table.find(key)
+	if i < 0 {
+		return LispFalse, false
+	}
+	return table.buckets[h][i].value, true
+}
+
+func (table *HashTable) Set(key, value LObj) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	h, i := table.find(key)
+	if i >= 0 {
+		table.buckets[h][i].value = value
+		return
+	}
+	table.buckets[h] = append(table.buckets[h], hashEntry{key, value})
+	table.count++
+}
+
+// delete key, false if not found
+func (table *HashTable) Delete(key LObj) bool {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	h, i := table.find(key)
+	if i < 0 {
+		return false
+	}
+	bucket := table.buckets[h]
+	if len(bucket) == 1 {
+		delete(table.buckets, h)
+	} else {
+		table.buckets[h] = append(bucket[:i:i], bucket[i+1:]...)
+	}
+	table.count--
+	return true
+}
+
+// number of keys
+func (table *HashTable) Len() int {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	return table.count
+}
+
+// snapshot of entries, in no particular order
+func (table *HashTable) entries() []hashEntry {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	entries := make([]hashEntry, 0, table.count)
+	for _, bucket := range table.buckets {
+		entries = append(entries, bucket...)
+	}
+	return entries
+}
+
+// hash table of args[0], and key args[1] if any
+func hashTableArgs(name string, args []LObj) (*HashTable, error) {
+	if args[0].Type != DTHashTable {
+		return nil, fmt.Errorf("%s: not hash table: %v", name, args[0])
+	}
+	table := args[0].Value.(*HashTable)
+	if len(args) > 1 {
+		if err := table.checkKey(name, args[1]); err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+// equivalence from optional procedure argument, equal? by default
+func equivalenceArg(name string, args []LObj, i int) (string, error) {
+	if i >= len(args) {
+		return "equal?", nil
+	}
+	if args[i].IsPrimitive() {
+		if e := args[i].Value.(*Primitive).Name; hashEquivalences[e].same != nil {
+			return e, nil
+		}
+	}
+	return "", fmt.Errorf("%s: unsupported equivalence: %v", name, args[i])
+}
+
+// cost of copying entries of table in args[0]
+func hashTableCost(args []LObj) int {
+	if args[0].Type != DTHashTable {
+		return 0
+	}
+	return args[0].Value.(*HashTable).Len() * 4 * objSize
+}
+
+// list of f of entries of table
+func entryList(name string, args []LObj, f func(e hashEntry) LObj) (LObj, error) {
+	table, err := hashTableArgs(name, args)
+	if err != nil {
+		return LispFalse, err
+	}
+	ret := LispNull
+	for _, e := range table.entries() {
+		ret = Cons(f(e), ret)
+	}
+	return ret, nil
+}
+
+// hash of args[0] less than optional bound args[1]
+func hashArg(name string, args []LObj, hash func(obj *LObj) uint64) (LObj, error) {
+	bound := int(^uint(0) >> 1)
+	if len(args) > 1 {
+		n, ok := args[1].Value.(int)
+		if !args[1].IsNumber() || !ok || n <= 0 {
+			return LispFalse, fmt.Errorf("%s: bad bound: %v", name, args[1])
+		}
+		bound = n
+	}
+	return NewNumber(int(hash(&args[0]) % uint64(bound))), nil
+}
+
+func init() {
+	// (make-hash-table [equivalence]), equivalence is eq?, eqv?, equal? or string=?
+	DefineAllocator("make-hash-table", 0, 1, func(args []LObj) int {
+		return 4 * objSize
+	}, func(args ...LObj) (LObj, error) {
+		e, err := equivalenceArg("make-hash-table", args, 0)
+		if err != nil {
+			return LispFalse, err
+		}
+		table, err := NewHashTable(e)
+		if err != nil {
+			return LispFalse, err
+		}
+		return NewHashTableObject(table), nil
+	})
+	DefinePrimitive("hash-table?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Type == DTHashTable), nil
+	})
+	// (alist->hash-table alist [equivalence]), the first one of duplicated keys is used
+	DefineAllocator("alist->hash-table", 1, 2, func(args []LObj) int {
+		return listsCost(args[:1]) * 2
+	}, func(args ...LObj) (LObj, error) {
+		e, err := equivalenceArg("alist->hash-table", args, 1)
+		if err != nil {
+			return LispFalse, err
+		}
+		elems, err := listElems("alist->hash-table", args[0])
+		if err != nil {
+			return LispFalse, err
+		}
+		table, err := NewHashTable(e)
+		if err != nil {
+			return LispFalse, err
+		}
+		for i := len(elems) - 1; i >= 0; i-- {
+			if !elems[i].IsPair() {
+				return LispFalse, fmt.Errorf("alist->hash-table: not association list: %v", args[0])
+			}
+			if err := table.checkKey("alist->hash-table", *elems[i].Car); err != nil {
+				return LispFalse, err
+			}
+			table.Set(*elems[i].Car, *elems[i].Cdr)
+		}
+		return NewHashTableObject(table), nil
+	})
+	// (hash-table-ref table key [failure [success]]),
+	// failure is called if key is not found, success with the value
+	DefineVMPrimitive("hash-table-ref", 2, 4, func(vm *VM, args ...LObj) (LObj, error) {
+		table, err := hashTableArgs("hash-table-ref", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		v, ok := table.Ref(args[1])
+		switch {
+		case ok && len(args) > 3:
+			return vm.TailCall(args[3], v)
+		case ok:
+			return v, nil
+		case len(args) > 2:
+			return vm.TailCall(args[2])
+		}
+		return LispFalse, fmt.Errorf("hash-table-ref: no key: %v", args[1])
+	})
+	DefinePrimitive("hash-table-ref/default", 3, 3, func(args ...LObj) (LObj, error) {
+		table, err := hashTableArgs("hash-table-ref/default", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		if v, ok := table.Ref(args[1]); ok {
+			return v, nil
+		}
+		return args[2], nil
+	})
+	DefineAllocator("hash-table-set!", 3, 3, func(args []LObj) int {
+		return 2 * objSize
+	}, func(args ...LObj) (LObj, error) {
+		table, err := hashTableArgs("hash-table-set!", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		table.Set(args[1], args[2])
+		return LispNull, nil
+	})
+	DefinePrimitive("hash-table-delete!", 2, 2, func(args ...LObj) (LObj, error) {
+		table, err := hashTableArgs("hash-table-delete!", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		table.Delete(args[1])
+		return LispNull, nil
+	})
+	DefinePrimitive("hash-table-exists?", 2, 2, func(args ...LObj) (LObj, error) {
+		table, err := hashTableArgs("hash-table-exists?", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		_, ok := table.Ref(args[1])
+		return NewBoolean(ok), nil
+	})
+	// (hash-table-update! table key proc [failure]), sets (proc value).
+	// the table is not locked while proc is called.
+	DefineVMPrimitive("hash-table-update!", 3, 4, func(vm *VM, args ...LObj) (LObj, error) {
+		table, err := hashTableArgs("hash-table-update!", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		v, ok := table.Ref(args[1])
+		if !ok {
+			if len(args) < 4 {
+				return LispFalse, fmt.Errorf("hash-table-update!: no key: %v", args[1])
+			}
+			if v, err = vm.Call(args[3]); err != nil {
+				return LispFalse, err
+			}
+		}
+		if v, err = vm.Call(args[2], v); err != nil {
+			return LispFalse, err
+		}
+		if err := vm.charge(2 * objSize); err != nil {
+			return LispFalse, err
+		}
+		table.Set(args[1], v)
+		return LispNull, nil
+	})
+	// (hash-table-update!/default table key proc default)
+	DefineVMPrimitive("hash-table-update!/default", 4, 4, func(vm *VM, args ...LObj) (LObj, error) {
+		table, err := hashTableArgs("hash-table-update!/default", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		v, ok := table.Ref(args[1])
+		if !ok {
+			v = args[3]
+		}
+		if v, err = vm.Call(args[2], v); err != nil {
+			return LispFalse, err
+		}
+		if err := vm.charge(2 * objSize); err != nil {
+			return LispFalse, err
+		}
+		table.Set(args[1], v)
+		return LispNull, nil
+	})
+	DefinePrimitive("hash-table-size", 1, 1, func(args ...LObj) (LObj, error) {
+		table, err := hashTableArgs("hash-table-size", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		return NewNumber(table.Len()), nil
+	})
+	// (hash-table-walk table proc), proc is called with each key and value
+	DefineVMPrimitive("hash-table-walk", 2, 2, func(vm *VM, args ...LObj) (LObj, error) {
+		table, err := hashTableArgs("hash-table-walk", args[:1])
+		if err != nil {
+			return LispFalse, err
+		}
+		if !args[1].IsProcedure() {
+			return LispFalse, fmt.Errorf("hash-table-walk: not procedure: %v", args[1])
+		}
+		for _, e := range table.entries() {
+			if _, err := vm.Call(args[1], e.key, e.value); err != nil {
+				return LispFalse, err
+			}
+		}
+		return LispNull, nil
+	})
+	// keys, values and entries are in no particular order
+	DefineAllocator("hash-table-keys", 1, 1, hashTableCost, func(args ...LObj) (LObj, error) {
+		return entryList("hash-table-keys", args, func(e hashEntry) LObj { return e.key })
+	})
+	DefineAllocator("hash-table-values", 1, 1, hashTableCost, func(args ...LObj) (LObj, error) {
+		return entryList("hash-table-values", args, func(e hashEntry) LObj { return e.value })
+	})
+	DefineAllocator("hash-table->alist", 1, 1, hashTableCost, func(args ...LObj) (LObj, error) {
+		return entryList("hash-table->alist", args, func(e hashEntry) LObj { return Cons(e.key, e.value) })
+	})
+	DefineAllocator("hash-table-copy", 1, 1, hashTableCost, func(args ...LObj) (LObj, error) {
+		table, err := hashTableArgs("hash-table-copy", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		copied, _ := NewHashTable(table.equivalence)
+		for _, e := range table.entries() {
+			copied.Set(e.key, e.value)
+		}
+		return NewHashTableObject(copied), nil
+	})
+	// (hash obj [bound]), consistent with equal?
+	DefinePrimitive("hash", 1, 2, func(args ...LObj) (LObj, error) {
+		return hashArg("hash", args, (*LObj).Hash)
+	})
+	DefinePrimitive("string-hash", 1, 2, func(args ...LObj) (LObj, error) {
+		if err := checkStrings("string-hash", args[:1]); err != nil {
+			return LispFalse, err
+		}
+		return hashArg("string-hash", args, (*LObj).Hash)
+	})
+	// consistent with eqv?
+	DefinePrimitive("hash-by-identity", 1, 2, func(args ...LObj) (LObj, error) {
+		return hashArg("hash-by-identity", args, identityHash)
+	})
+
+	DefineLibrary("(srfi 69)",
+		"make-hash-table", "hash-table?", "alist->hash-table",
+		"hash-table-ref", "hash-table-ref/default", "hash-table-set!", "hash-table-delete!",
+		"hash-table-exists?", "hash-table-update!", "hash-table-update!/default", "hash-table-size",
+		"hash-table-walk", "hash-table-keys", "hash-table-values", "hash-table->alist", "hash-table-copy",
+		"hash", "string-hash", "hash-by-identity")
+}
@@ -0,0 +1,243 @@
+package rgors
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Interpreter is the embedding API.
+// it evaluates code in its own environment on its own VM.
+// set limits and Tracer on VM. not safe for concurrent use.
+type Interpreter struct {
+	Environment *Environment
+	VM          *VM
+}
+
+// interpreter with all libraries
+func NewInterpreter() *Interpreter {
+	environment := NewEnvironment()
+	for _, name := range Libraries() {
+		environment.Import(name)
+	}
+	return NewInterpreterIn(environment)
+}
+
+// interpreter in environment, e.g. made by NewSandbox
+func NewInterpreterIn(environment *Environment) *Interpreter {
+	return &Interpreter{Environment: environment, VM: NewVM()}
+}
+
+// evaluate all expressions in src, return the last value
+func (interp *Interpreter) EvalString(src string) (LObj, error) {
+	p := Parser{}
+	program, err := p.ParseString(src)
+	if err != nil {
+		return LispFalse, err
+	}
+	ans := LispNull
+	for _, expr := range program {
+		code, err := expr.CompileIn(interp.Environment, p.Source)
+		if err != nil {
+			return LispFalse, err
+		}
+		if ans, err = interp.run(code); err != nil {
+			return LispFalse, err
+		}
+	}
+	return ans, nil
+}
+
+// evaluate expression
+func (interp *Interpreter) Eval(expr LObj) (LObj, error) {
+	code, err := expr.CompileIn(interp.Environment, nil)
+	if err != nil {
+		return LispFalse, err
+	}
+	return interp.run(code)
+}
+
+func (interp *Interpreter) run(code *Code) (LObj, error) {
+	interp.VM.Load(code)
+	return interp.VM.Run()
+}
+
+// call global procedure with arguments converted by FromGo
+func (interp *Interpreter) Call(procName string, args ...interface{}) (LObj, error) {
+	proc, ok := interp.Environment.LookUp(NewSymbol(procName)).Value()
+	if !ok {
+		return LispFalse, fmt.Errorf("unbound variable: %s", procName)
+	}
+	objs := make([]LObj, len(args))
+	for i, arg := range args {
+		obj, err := FromGo(arg)
+		if err != nil {
+			return LispFalse, err
+		}
+		objs[i] = obj
+	}
+	return interp.Apply(proc, objs...)
+}
+
+// apply procedure to arguments
+func (interp *Interpreter) Apply(proc LObj, args ...LObj) (LObj, error) {
+	if !proc.IsProcedure() {
+		return LispFalse, fmt.Errorf("not procedure: %v", proc)
+	}
+	return interp.VM.Apply(proc, args...)
+}
+
+// bind global variable to Go value converted by FromGo.
+// function is named name.
+func (interp *Interpreter) Define(name string, value interface{}) error {
+	if reflect.ValueOf(value).Kind() == reflect.Func {
+		prim, err := wrapGoFunc(name, value)
+		if err != nil {
+			return err
+		}
+		interp.Environment.Define(name, prim)
+		return nil
+	}
+	obj, err := FromGo(value)
+	if err != nil {
+		return err
+	}
+	interp.Environment.Define(name, obj)
+	return nil
+}
+
+// Symbol is Go representation of Scheme symbol
+type Symbol string
+
+var symbolType = reflect.TypeOf(Symbol(""))
+
+// convert Go value to LObj.
+//
+//	nil -> ()
+//	bool -> boolean
+//	integers -> exact number, floats -> inexact number
+//	string -> string, Symbol -> symbol
+//	slice, array -> list
+//	map -> association list sorted by key
+//	func -> primitive by WrapGoFunc, VM-aware if it takes *VM first
+//	chan LObj -> channel
+//	*HashTable -> hash table
+//	registered foreign type -> foreign object
+//
+// LObj is returned as it is.
+func FromGo(value interface{}) (LObj, error) {
+	switch v := value.(type) {
+	case nil:
+		return LispNull, nil
+	case LObj:
+		return v, nil
+	case bool:
+		return NewBoolean(v), nil
+	case string:
+		return NewString(v), nil
+	case Symbol:
+		return *NewSymbol(string(v)), nil
+	case func(args ...LObj) (LObj, error):
+		return NewPrimitive("<go>", 0, -1, v), nil
+	case func(vm *VM, args ...LObj) (LObj, error):
+		return NewVMPrimitive("<go>", 0, -1, v), nil
+	case chan LObj:
+		return NewChannel(v), nil
+	case *HashTable:
+		return NewHashTableObject(v), nil
+	}
+	if _, ok := lookUpForeignType(reflect.TypeOf(value)); ok {
+		return NewForeign(value)
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewNumber(int(rv.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return NewNumber(int(rv.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return NewNumber(rv.Float()), nil
+	case reflect.String: // named string type
+		return NewString(rv.String()), nil
+	case reflect.Bool:
+		return NewBoolean(rv.Bool()), nil
+	case reflect.Slice, reflect.Array:
+		elems := make([]LObj, rv.Len())
+		for i := range elems {
+			elem, err := FromGo(rv.Index(i).Interface())
+			if err != nil {
+				return LispFalse, err
+			}
+			elems[i] = elem
+		}
+		return NewList(elems...), nil
+	case reflect.Func:
+		return WrapGoFunc(value)
+	case reflect.Map:
+		keys := rv.MapKeys()
+		pairs := make([]LObj, len(keys))
+		for i, key := range keys {
+			k, err := FromGo(key.Interface())
+			if err != nil {
+				return LispFalse, err
+			}
+			v, err := FromGo(rv.MapIndex(key).Interface())
+			if err != nil {
+				return LispFalse, err
+			}
+			pairs[i] = Cons(k, v)
+		}
+		sort.Slice(pairs, func(i, j int) bool {
+			return pairs[i].Car.String() < pairs[j].Car.String()
+		})
+		return NewList(pairs...), nil
+	}
+	return LispFalse, fmt.Errorf("cannot convert %T to Scheme", value)
+}
+
+// convert LObj to Go value.
+//
+//	() -> []interface{}{}
+//	boolean -> bool
+//	number -> int or float64
+//	string -> string, symbol -> Symbol, char -> rune
+//	list, vector -> []interface{}
+//	channel -> chan LObj
+//	hash table -> *HashTable
+//	foreign object -> its Go value
+//
+// other objects, e.g. procedures and dotted pairs, are returned as LObj.
+func ToGo(obj LObj) interface{} {
+	switch obj.Type {
+	case DTBoolean:
+		return obj.Value.(bool)
+	case DTNumber, DTChar:
+		return obj.Value
+	case DTString:
+		return obj.goString()
+	case DTSymbol:
+		return Symbol(obj.Value.(string))
+	case DTNull, DTPair:
+		if !obj.IsList() {
+			return obj
+		}
+		elems := make([]interface{}, 0)
+		for elem := &obj; elem.IsPair(); elem = elem.Cdr {
+			elems = append(elems, ToGo(*elem.Car))
+		}
+		return elems
+	case DTVector:
+		elems := make([]interface{}, 0)
+		for _, elem := range obj.Value.([]LObj) {
+			elems = append(elems, ToGo(elem))
+		}
+		return elems
+	case DTChannel:
+		return obj.Value.(chan LObj)
+	case DTHashTable:
+		return obj.Value.(*HashTable)
+	case DTForeign:
+		return obj.Value.(*Foreign).Value
+	}
+	return obj
+}
@@ -8,12 +8,14 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // Lexer
 type Lexer struct {
 	Reader   io.RuneScanner
 	Token    Token
+	FoldCase bool // case-insensitive identifiers, toggled by #!fold-case
 	position Position
 }
 
@@ -31,6 +33,19 @@ type Position struct {
 	total    int
 }
 
+func (pos Position) Filename() string {
+	return pos.filename
+}
+
+// 1 origin line number
+func (pos Position) Line() int {
+	return pos.row + 1
+}
+
+func (pos Position) String() string {
+	return fmt.Sprintf("%s:%d", pos.filename, pos.Line())
+}
+
 type LexerError struct {
 	Kind     int      // token kind
 	Text     string   // message
@@ -200,27 +215,154 @@ func (lx *Lexer) ReadIdent() (Token, error) {
 	// Ignore EOF
 	s, _, _ := lx.ReadWhile(IsIdentSubseq)
 	s = string(initial) + s
-	return Token{Kind: Ident, Text: s, Value: s}, nil
+	return Token{Kind: Ident, Text: s, Value: lx.fold(s)}, nil
+}
+
+// fold identifier when case-insensitive mode
+func (lx *Lexer) fold(s string) string {
+	if lx.FoldCase {
+		return strings.ToLower(s)
+	}
+	return s
 }
 
 // Ident character
 func IsIdentInitial(r rune) bool {
-	return strings.ContainsRune("!$%&*/:<=>?^_~", r) || unicode.IsLetter(r)
+	if r < utf8.RuneSelf {
+		return strings.ContainsRune("!$%&*/:<=>?^_~", r) || unicode.IsLetter(r)
+	}
+	// non ascii: Lu, Ll, Lt, Lm, Lo, Mn, Nl, No, Pd, Pc, Po, Sc, Sm, Sk, So, Co
+	return unicode.In(r, unicode.L, unicode.Mn, unicode.Nl, unicode.No,
+		unicode.Pd, unicode.Pc, unicode.Po, unicode.Sc, unicode.Sm,
+		unicode.Sk, unicode.So, unicode.Co)
 }
 func IsIdentSubseq(r rune) bool {
+	if r >= utf8.RuneSelf && unicode.In(r, unicode.Mc, unicode.Me) {
+		return true
+	}
 	return IsIdentInitial(r) || unicode.IsDigit(r) || strings.ContainsRune("+-.@", r)
 }
 
+// <sign subsequent> and <dot subsequent>
+func isSignSubseq(r rune) bool {
+	return IsIdentInitial(r) || r == '+' || r == '-' || r == '@'
+}
+func isDotSubseq(r rune) bool {
+	return isSignSubseq(r) || r == '.'
+}
+
+func allIdentSubseq(rs []rune) bool {
+	for _, r := range rs {
+		if !IsIdentSubseq(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsIdentifier reports whether s reads back as the symbol s
+// without vertical bars.
+func IsIdentifier(s string) bool {
+	rs := []rune(s)
+	switch {
+	case len(rs) == 0:
+		return false
+	case IsIdentInitial(rs[0]):
+		return allIdentSubseq(rs[1:])
+	case rs[0] == '+' || rs[0] == '-': // peculiar identifier
+		switch {
+		case len(rs) == 1:
+			return true
+		case isSignSubseq(rs[1]):
+			return allIdentSubseq(rs[2:])
+		case rs[1] == '.':
+			return len(rs) > 2 && isDotSubseq(rs[2]) && allIdentSubseq(rs[3:])
+		}
+		return false
+	case rs[0] == '.':
+		return len(rs) > 1 && isDotSubseq(rs[1]) && allIdentSubseq(rs[2:])
+	default:
+		return false
+	}
+}
+
+// Read peculiar identifier, e.g. + - ... ->x +.foo
+// prefix has already been read.
+func (lx *Lexer) ReadPeculiar(prefix string) (Token, error) {
+	s, _, _ := lx.ReadWhile(IsIdentSubseq)
+	s = prefix + s
+	if !IsIdentifier(s) {
+		return Token{Kind: Error}, lx.NewError(Ident, "illegal identifier "+s)
+	}
+	return Token{Kind: Ident, Text: s, Value: lx.fold(s)}, nil
+}
+
+// Read |symbol with spaces|
+// first vertical bar has already been read.
+func (lx *Lexer) ReadBarIdent() (Token, error) {
+	rs := make([]rune, 0)
+	for {
+		r, _, eof := lx.ReadRune()
+		switch {
+		case eof != nil:
+			return Token{Kind: EOF}, &UnclosedError{Text: "|"}
+		case r == '|':
+			s := string(rs)
+			return Token{Kind: Ident, Text: SymbolString(s), Value: s}, nil
+		case r == '\\':
+			rr, err := lx.ReadEscape()
+			if err != nil {
+				return Token{Kind: Error}, err
+			}
+			rs = append(rs, rr)
+		default:
+			rs = append(rs, r)
+		}
+	}
+}
+
+// Read escape sequence in |symbol|
+// backslash has already been read.
+func (lx *Lexer) ReadEscape() (rune, error) {
+	r, _, err := lx.ReadRune()
+	if err != nil {
+		return r, &UnclosedError{Text: "|"}
+	}
+	switch r {
+	case 'a':
+		return '\a', nil
+	case 'b':
+		return '\b', nil
+	case 't':
+		return '\t', nil
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case '|', '\\', '"':
+		return r, nil
+	case 'x', 'X': // \x41;
+		hex, _, _ := lx.ReadWhile(func(r rune) bool { return r != ';' && r != '|' })
+		if r, _, _ := lx.ReadRune(); r != ';' {
+			return 0, lx.NewError(Ident, "unterminated hex escape \\x"+hex)
+		}
+		code, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return 0, lx.NewError(Ident, "illegal hex escape \\x"+hex)
+		}
+		return rune(code), nil
+	default:
+		return 0, lx.NewError(Ident, "illegal escape \\"+string(r))
+	}
+}
+
 // error: EOF or Illegal dot
+// first dot has already been read.
 func (lx *Lexer) ReadDot() (Token, error) {
-	s, size, _ := lx.ReadWhile(func(r rune) bool { return r == '.' })
-	if size == 2 {
-		return Token{Kind: Ident, Text: "...", Value: "..."}, nil
-	} else if size == 0 {
+	if r, err := lx.PeekRune(); err != nil || !IsIdentSubseq(r) {
 		return Token{Kind: Dot, Text: ".", Value: "."}, nil
-	} else {
-		return Token{Kind: Error}, lx.NewError(Dot, "illegal dot before "+s)
 	}
+	return lx.ReadPeculiar(".")
 }
 
 // Read # start token
@@ -239,12 +381,29 @@ func (lx *Lexer) ReadSharp() (Token, error) {
 		token = Token{Kind: Boolean, Text: "#f", Value: false}
 	case '\\': // Char
 		token, err = lx.ReadChar()
+	case '!': // Directive
+		token, err = lx.ReadDirective()
 	default:
 		token, err = Token{Kind: Error}, lx.NewError(Error, string(r)+"after #")
 	}
 	return token, err
 }
 
+// #!fold-case and #!no-fold-case
+// directive is treated as comment
+func (lx *Lexer) ReadDirective() (Token, error) {
+	s, _, _ := lx.ReadWhile(IsIdentSubseq)
+	switch s {
+	case "fold-case":
+		lx.FoldCase = true
+	case "no-fold-case":
+		lx.FoldCase = false
+	default:
+		return Token{Kind: Error}, lx.NewError(Comment, "unknown directive #!"+s)
+	}
+	return Token{Kind: Comment, Text: "#!" + s, Value: s}, nil
+}
+
 // e.g. #\a
 // not support char name (#\newline, #\space)
 func (lx *Lexer) ReadChar() (Token, error) {
@@ -326,8 +485,10 @@ func (lx *Lexer) ReadToken() (Token, error) {
 		if nxt, _ := lx.PeekRune(); unicode.IsDigit(nxt) {
 			lx.Token, err = lx.ReadNumber(r)
 		} else {
-			lx.Token = Token{Kind: Ident, Text: string(r), Value: string(r)}
+			lx.Token, err = lx.ReadPeculiar(string(r))
 		}
+	case r == '|':
+		lx.Token, err = lx.ReadBarIdent()
 	case r == ';':
 		lx.Token, err = lx.ReadComment()
 	case r == '(':
@@ -368,8 +529,13 @@ func (lx *Lexer) SetFile(name string) {
 	if err != nil {
 		panic(err)
 	}
+	lx.SetReader(name, fp)
+}
+
+// set Lexer's Reader, name is used in positions
+func (lx *Lexer) SetReader(name string, r io.Reader) {
 	lx.position = Position{filename: name}
-	lx.Reader = bufio.NewReader(fp)
+	lx.Reader = bufio.NewReader(r)
 }
 
 // set Lexer's Reader
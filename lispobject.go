@@ -2,6 +2,10 @@ package rgors
 
 import (
 	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
 )
 
 // Lisp object is used as AST, Lisp code, and secd machine code
@@ -12,12 +16,24 @@ const (
 	DTChar
 	DTVector
 	DTPrimitive // built in, Value is go function
-	DTClosure   // compound car is code, cdr is env
+	DTClosure   // compound, Value is *Closure
 	DTPair
 	DTNumber
 	DTString
 	DTPort
 	DTNull
+	DTContinuation      // Value is *Continuation
+	DTBox               // assigned variable, Car is its value
+	DTError             // Value is *ErrorObject
+	DTEnvironment       // Value is *Environment
+	DTForeign           // Value is *Foreign
+	DTThread            // Value is *Thread
+	DTMutex             // Value is *Mutex
+	DTConditionVariable // Value is *ConditionVariable
+	DTChannel           // Value is chan LObj
+	DTEOF
+	DTHashTable // Value is *HashTable
+	DTValues    // Value is []LObj, other than one value made by values
 )
 
 // car & cdr is only used when Type is DTPair
@@ -32,23 +48,191 @@ type LObj struct {
 var LispFalse = LObj{Type: DTBoolean, Value: false}
 var LispTrue = LObj{Type: DTBoolean, Value: true}
 var LispNull = LObj{Type: DTNull}
+var LispEOF = LObj{Type: DTEOF}
+
+// external representation.
+// pairs and vectors on cycles are written with datum labels, #n= and #n#.
+func (obj LObj) String() string {
+	p := newPrinter(&obj)
+	p.write(&obj)
+	return p.b.String()
+}
 
-// pair to string (recursive)
-func (obj LObj) pairString() string {
-	var text string
-	text = fmt.Sprintf("%v", *obj.Car)
-	switch obj.Cdr.Type {
-	case DTNull:
-		text += ")"
+// external representation cut after a few elements and levels,
+// for error messages
+func (obj LObj) shortString() string {
+	p := &printer{maxLength: 8, maxDepth: 4}
+	p.write(&obj)
+	return p.b.String()
+}
+
+type printer struct {
+	b      strings.Builder
+	labels map[interface{}]int // containers on cycles to label, -1 until written
+	next   int                 // next label
+
+	// cut off with "...", 0 means no limit
+	maxLength int // elements of a list or vector
+	maxDepth  int // nested lists and vectors
+	depth     int
+}
+
+// printer with labels for the cycles in obj
+func newPrinter(obj *LObj) *printer {
+	p := &printer{labels: make(map[interface{}]int)}
+	p.findCycles(obj, make(map[interface{}]bool))
+	return p
+}
+
+// identity of containers which can be on cycles, nil for others
+func containerKey(obj *LObj) interface{} {
+	switch obj.Type {
 	case DTPair:
-		text += " " + obj.Cdr.pairString()
+		return obj.Car
+	case DTVector:
+		if v := obj.Value.([]LObj); len(v) > 0 {
+			return &v[0]
+		}
+	case DTError:
+		return obj.Value.(*ErrorObject)
+	}
+	return nil
+}
+
+// add containers reached again from inside themselves to labels.
+// visiting has containers being walked, false when done.
+func (p *printer) findCycles(obj *LObj, visiting map[interface{}]bool) {
+	walked := make([]interface{}, 0)
+	defer func() {
+		for _, key := range walked {
+			visiting[key] = false
+		}
+	}()
+	for { // cdr down without recursion
+		key := containerKey(obj)
+		if key == nil {
+			return
+		}
+		if now, seen := visiting[key]; seen {
+			if now {
+				p.labels[key] = -1
+			}
+			return
+		}
+		visiting[key] = true
+		walked = append(walked, key)
+		switch obj.Type {
+		case DTVector:
+			for i := range obj.Value.([]LObj) {
+				p.findCycles(&obj.Value.([]LObj)[i], visiting)
+			}
+			return
+		case DTError:
+			obj = &obj.Value.(*ErrorObject).Irritants
+		default: // pair
+			p.findCycles(obj.Car, visiting)
+			obj = obj.Cdr
+		}
+	}
+}
+
+// true if obj is labeled, #n# is written if it has been written
+func (p *printer) writeLabel(obj *LObj) bool {
+	key := containerKey(obj)
+	if key == nil {
+		return false
+	}
+	n, ok := p.labels[key]
+	if !ok {
+		return false
+	}
+	if n >= 0 {
+		fmt.Fprintf(&p.b, "#%d#", n)
+		return true
+	}
+	p.labels[key] = p.next
+	fmt.Fprintf(&p.b, "#%d=", p.next)
+	p.next++
+	return false
+}
+
+func (p *printer) write(obj *LObj) {
+	if p.writeLabel(obj) {
+		return
+	}
+	switch obj.Type {
+	case DTPair, DTVector:
+		if p.maxDepth > 0 && p.depth >= p.maxDepth {
+			p.b.WriteString("...")
+			return
+		}
+		p.depth++
+		defer func() { p.depth-- }()
+	}
+	switch obj.Type {
+	case DTPair:
+		p.b.WriteString("(")
+		p.write(obj.Car)
+		p.writeTail(obj.Cdr, 1)
+		p.b.WriteString(")")
+	case DTVector:
+		p.b.WriteString("#(")
+		for i := range obj.Value.([]LObj) {
+			if p.maxLength > 0 && i >= p.maxLength {
+				p.b.WriteString(" ...")
+				break
+			}
+			if i > 0 {
+				p.b.WriteString(" ")
+			}
+			p.write(&obj.Value.([]LObj)[i])
+		}
+		p.b.WriteString(")")
+	case DTError:
+		e := obj.Value.(*ErrorObject)
+		p.b.WriteString("<error ")
+		p.b.WriteString(e.Message)
+		p.writeTail(&e.Irritants, 0)
+		p.b.WriteString(">")
+	case DTBox:
+		p.b.WriteString("<box ")
+		p.write(obj.Car)
+		p.b.WriteString(">")
+	case DTValues: // as the REPL shows them
+		for i := range obj.Value.([]LObj) {
+			if i > 0 {
+				p.b.WriteString(" ")
+			}
+			p.write(&obj.Value.([]LObj)[i])
+		}
 	default:
-		text += " . " + obj.Cdr.String() + ")"
+		p.b.WriteString(obj.atomString())
 	}
-	return text
 }
 
-func (obj LObj) String() (text string) {
+// rest of list from obj, whose first n elements are written.
+// labeled or not pair rest is written after " . ".
+func (p *printer) writeTail(obj *LObj, n int) {
+	for ; obj.IsPair(); obj = obj.Cdr {
+		if _, ok := p.labels[containerKey(obj)]; ok {
+			break
+		}
+		if p.maxLength > 0 && n >= p.maxLength {
+			p.b.WriteString(" ...")
+			return
+		}
+		p.b.WriteString(" ")
+		p.write(obj.Car)
+		n++
+	}
+	if !obj.IsNull() {
+		p.b.WriteString(" . ")
+		p.write(obj)
+	}
+}
+
+// representation of objects other than pairs, vectors, errors and boxes
+func (obj LObj) atomString() (text string) {
 	switch obj.Type {
 	case DTBoolean:
 		if obj.Value == true {
@@ -56,24 +240,77 @@ func (obj LObj) String() (text string) {
 		} else {
 			text = "#f"
 		}
-	case DTPair:
-		text = fmt.Sprintf("(%v", obj.pairString())
+	case DTSymbol:
+		text = SymbolString(obj.Value.(string))
 	case DTString:
-		text = fmt.Sprintf("\"%v\"", obj.Value)
+		text = fmt.Sprintf("\"%s\"", obj.goString())
 	case DTNull:
 		text = "()"
 	case DTChar:
 		text = string(obj.Value.(rune))
 	case DTPrimitive:
-		text = "<primitive>"
+		text = fmt.Sprintf("<primitive %s>", obj.Value.(*Primitive).Name)
 	case DTClosure:
-		text = fmt.Sprintf("(^ %v : %v)", obj.Body(), obj.Env())
+		text = obj.Value.(*Closure).String()
+	case DTContinuation:
+		text = "<continuation>"
+	case DTEnvironment:
+		text = "<environment>"
+	case DTForeign:
+		text = obj.Value.(*Foreign).String()
+	case DTThread:
+		text = obj.Value.(*Thread).String()
+	case DTMutex:
+		text = obj.Value.(*Mutex).String()
+	case DTConditionVariable:
+		text = obj.Value.(*ConditionVariable).String()
+	case DTChannel:
+		text = "<channel>"
+	case DTEOF:
+		text = "#<eof>"
+	case DTHashTable:
+		text = obj.Value.(*HashTable).String()
 	default:
 		text = fmt.Sprintf("%v", obj.Value)
 	}
 	return text
 }
 
+// symbol name to external representation
+// bar-quote names that would not re-read as the same symbol
+func SymbolString(name string) string {
+	if IsIdentifier(name) {
+		return name
+	}
+	var b strings.Builder
+	b.WriteRune('|')
+	for _, r := range name {
+		switch r {
+		case '|', '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case '\a':
+			b.WriteString("\\a")
+		case '\b':
+			b.WriteString("\\b")
+		case '\t':
+			b.WriteString("\\t")
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		default:
+			if unicode.IsPrint(r) {
+				b.WriteRune(r)
+			} else {
+				fmt.Fprintf(&b, "\\x%x;", r)
+			}
+		}
+	}
+	b.WriteRune('|')
+	return b.String()
+}
+
 // convert lisp object to go bool
 func (obj *LObj) ToBool() bool {
 	return !(obj.Type == DTBoolean && !obj.Value.(bool))
@@ -100,11 +337,27 @@ func (obj *LObj) IsNumber() bool {
 	return obj.Type == DTNumber
 }
 
+// proper list, false for circular list
 func (obj *LObj) IsList() bool {
-	if obj.IsPair() {
-		return obj.Cdr.IsList()
+	end := obj.listEnd()
+	return end != nil && end.IsNull()
+}
+
+// object after the last pair, nil if obj is circular
+func (obj *LObj) listEnd() *LObj {
+	slow, fast := obj, obj
+	for {
+		for i := 0; i < 2; i++ {
+			if !fast.IsPair() {
+				return fast
+			}
+			fast = fast.Cdr
+		}
+		slow = slow.Cdr
+		if fast.IsPair() && fast.Car == slow.Car { // same pair
+			return nil
+		}
 	}
-	return obj.IsNull()
 }
 
 func (obj *LObj) IsSelfEvaluating() bool {
@@ -124,8 +377,12 @@ func (obj *LObj) IsPrimitive() bool {
 	return obj.Type == DTPrimitive
 }
 
+func (obj *LObj) IsContinuation() bool {
+	return obj.Type == DTContinuation
+}
+
 func (obj *LObj) IsProcedure() bool {
-	return obj.IsClosure() || obj.IsPrimitive()
+	return obj.IsClosure() || obj.IsPrimitive() || obj.IsContinuation()
 }
 
 // List utilities
@@ -209,11 +466,84 @@ func (obj *LObj) Push(car *LObj) {
 	*obj = Cons(*car, *obj)
 }
 
-// compare by pointer
+// identity, eq?
+// pairs, strings, vectors and procedures are compared by pointer,
+// other objects by value.
 func (obj1 *LObj) Eq(obj2 *LObj) bool {
+	if obj1.Type != obj2.Type {
+		return false
+	}
+	if obj1.Type == DTVector || obj1.Type == DTValues { // slices are not comparable
+		v1, v2 := obj1.Value.([]LObj), obj2.Value.([]LObj)
+		return len(v1) == len(v2) && (len(v1) == 0 || &v1[0] == &v2[0])
+	}
 	return *obj1 == *obj2
 }
 
+// eqv?, eq? but inexact numbers are compared by bits:
+// NaNs are eqv? and 0.0 is not eqv? to -0.0
+func (obj1 *LObj) Eqv(obj2 *LObj) bool {
+	if f1, ok := obj1.Value.(float64); ok && obj1.Type == DTNumber {
+		f2, ok := obj2.Value.(float64)
+		return ok && obj2.Type == DTNumber && math.Float64bits(f1) == math.Float64bits(f2)
+	}
+	return obj1.Eq(obj2)
+}
+
+// structural equality, equal?
+// pairs and vectors are compared by elements, strings by characters,
+// foreign objects by ForeignType.Equal, others by eqv?.
+// cyclic structures are equal if they can not be told apart.
+func (obj1 *LObj) Equal(obj2 *LObj) bool {
+	return equal(obj1, obj2, make(map[[2]*LObj]bool))
+}
+
+// seen has pairs of pairs and vectors being compared, by their first cells
+func equal(a, b *LObj, seen map[[2]*LObj]bool) bool {
+	for {
+		if a.Eqv(b) {
+			return true
+		}
+		if a.Type != b.Type {
+			return false
+		}
+		switch a.Type {
+		case DTString:
+			return string(a.runes()) == string(b.runes())
+		case DTForeign:
+			return a.Value.(*Foreign).Equal(b.Value.(*Foreign))
+		case DTVector:
+			v1, v2 := a.Value.([]LObj), b.Value.([]LObj)
+			if len(v1) != len(v2) {
+				return false
+			}
+			key := [2]*LObj{&v1[0], &v2[0]} // not empty, they are not eq?
+			if seen[key] {
+				return true
+			}
+			seen[key] = true
+			for i := range v1 {
+				if !equal(&v1[i], &v2[i], seen) {
+					return false
+				}
+			}
+			return true
+		case DTPair:
+			key := [2]*LObj{a.Car, b.Car}
+			if seen[key] {
+				return true
+			}
+			seen[key] = true
+			if !equal(a.Car, b.Car, seen) {
+				return false
+			}
+			a, b = a.Cdr, b.Cdr
+		default:
+			return false
+		}
+	}
+}
+
 // utility
 func (obj *LObj) CarEq(s string) bool {
 	return obj.Car.Eq(NewSymbol(s))
@@ -241,15 +571,17 @@ func (alist *LObj) Assq(sym LObj) (LObj, error) {
 	}
 }
 
-var symbolTable map[string]*LObj = make(map[string]*LObj, 0)
+// intern table, name to *LObj.
+// safe for concurrent parsers.
+var symbolTable sync.Map
 
 func NewSymbol(s string) *LObj {
-	sym, ok := symbolTable[s] // search intern table
-	if ok {
-		return sym
+	if sym, ok := symbolTable.Load(s); ok { // search intern table
+		return sym.(*LObj)
 	}
-	symbolTable[s] = &LObj{Type: DTSymbol, Value: s} // intern
-	return symbolTable[s]                            // return symbol
+	// intern, another goroutine may have done it
+	sym, _ := symbolTable.LoadOrStore(s, &LObj{Type: DTSymbol, Value: s})
+	return sym.(*LObj)
 }
 
 func NewList(objs ...LObj) LObj {
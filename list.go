@@ -0,0 +1,318 @@
+package rgors
+
+import (
+	"fmt"
+)
+
+// lists
+// pairs are mutable, procedures taking procedures call them by vm.Call.
+
+// elements of proper list
+func listElems(name string, obj LObj) ([]LObj, error) {
+	if !obj.IsList() {
+		return nil, fmt.Errorf("%s: not list: %s", name, obj.shortString())
+	}
+	elems := make([]LObj, 0)
+	for elem := &obj; elem.IsPair(); elem = elem.Cdr {
+		elems = append(elems, *elem.Car)
+	}
+	return elems, nil
+}
+
+// cost of copying the lists in args
+func listsCost(args []LObj) int {
+	n := 0
+	for _, arg := range args {
+		if !arg.IsList() { // circular or the last of append
+			continue
+		}
+		for elem := &arg; elem.IsPair(); elem = elem.Cdr {
+			n++
+		}
+	}
+	return n * 2 * objSize
+}
+
+// equivalence of member and assoc, compare is a procedure or nil for equal?
+func equivalence(vm *VM, compare *LObj) func(x, y LObj) (bool, error) {
+	if compare == nil {
+		return func(x, y LObj) (bool, error) { return x.Equal(&y), nil }
+	}
+	return func(x, y LObj) (bool, error) {
+		ret, err := vm.Call(*compare, x, y)
+		return ret.ToBool(), err
+	}
+}
+
+// first pair of list whose car is x, #f if none
+func member(name string, x, list LObj, eq func(x, y LObj) (bool, error)) (LObj, error) {
+	if list.listEnd() == nil {
+		return LispFalse, fmt.Errorf("%s: circular list", name)
+	}
+	elem := &list
+	for ; elem.IsPair(); elem = elem.Cdr {
+		found, err := eq(x, *elem.Car)
+		if err != nil {
+			return LispFalse, err
+		}
+		if found {
+			return *elem, nil
+		}
+	}
+	if !elem.IsNull() {
+		return LispFalse, fmt.Errorf("%s: not list: %s", name, list.shortString())
+	}
+	return LispFalse, nil
+}
+
+// first pair of alist whose car is x, #f if none
+func assoc(name string, x, alist LObj, eq func(x, y LObj) (bool, error)) (LObj, error) {
+	if alist.listEnd() == nil {
+		return LispFalse, fmt.Errorf("%s: circular list", name)
+	}
+	elem := &alist
+	for ; elem.IsPair(); elem = elem.Cdr {
+		if !elem.Car.IsPair() {
+			return LispFalse, fmt.Errorf("%s: not association list: %v", name, alist)
+		}
+		found, err := eq(x, *elem.Car.Car)
+		if err != nil {
+			return LispFalse, err
+		}
+		if found {
+			return *elem.Car, nil
+		}
+	}
+	if !elem.IsNull() {
+		return LispFalse, fmt.Errorf("%s: not list: %s", name, alist.shortString())
+	}
+	return LispFalse, nil
+}
+
+// cars of lists, which are advanced to their cdrs. false if any list ends
+func nextCars(lists []LObj) ([]LObj, bool) {
+	cars := make([]LObj, len(lists))
+	for i := range lists {
+		if !lists[i].IsPair() {
+			return nil, false
+		}
+		cars[i] = *lists[i].Car
+	}
+	for i := range lists {
+		lists[i] = *lists[i].Cdr
+	}
+	return cars, true
+}
+
+// new list of elems charged to vm
+func chargedList(vm *VM, elems []LObj) (LObj, error) {
+	if err := vm.charge(len(elems) * 2 * objSize); err != nil {
+		return LispFalse, err
+	}
+	return NewList(elems...), nil
+}
+
+// apply proc to cars of lists until the shortest one ends, collect results if results.
+// each result is charged when collected, lists can be circular.
+func mapLists(vm *VM, name string, args []LObj, results bool) (LObj, error) {
+	if !args[0].IsProcedure() {
+		return LispFalse, fmt.Errorf("%s: not procedure: %v", name, args[0])
+	}
+	lists := append([]LObj(nil), args[1:]...)
+	ret := make([]LObj, 0)
+	for {
+		cars, ok := nextCars(lists)
+		if !ok {
+			if results {
+				return NewList(ret...), nil
+			}
+			return LispNull, nil
+		}
+		v, err := vm.Call(args[0], cars...)
+		if err != nil {
+			return LispFalse, err
+		}
+		if results {
+			if err := vm.charge(2 * objSize); err != nil {
+				return LispFalse, err
+			}
+			ret = append(ret, v)
+		}
+	}
+}
+
+func init() {
+	DefinePrimitive("set-car!", 2, 2, func(args ...LObj) (LObj, error) {
+		if !args[0].IsPair() {
+			return LispFalse, fmt.Errorf("set-car!: not pair: %v", args[0])
+		}
+		return LispNull, args[0].SetCar(args[1])
+	})
+	DefinePrimitive("set-cdr!", 2, 2, func(args ...LObj) (LObj, error) {
+		if !args[0].IsPair() {
+			return LispFalse, fmt.Errorf("set-cdr!: not pair: %v", args[0])
+		}
+		return LispNull, args[0].SetCdr(args[1])
+	})
+	// c[ad][ad]r
+	for _, name := range []string{"caar", "cadr", "cdar", "cddr"} {
+		name := name
+		DefinePrimitive(name, 1, 1, func(args ...LObj) (LObj, error) {
+			obj := args[0]
+			for i := 2; i > 0; i-- {
+				if !obj.IsPair() {
+					return LispFalse, fmt.Errorf("%s: bad argument: %v", name, args[0])
+				}
+				if name[i] == 'a' {
+					obj = *obj.Car
+				} else {
+					obj = *obj.Cdr
+				}
+			}
+			return obj, nil
+		})
+	}
+	DefinePrimitive("list?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].IsList()), nil
+	})
+	// (make-list k [fill])
+	DefineAllocator("make-list", 1, 2, func(args []LObj) int {
+		return sizeCost(args[0], 2*objSize)
+	}, func(args ...LObj) (LObj, error) {
+		k, err := sizeArg("make-list", args, 0, 2*objSize)
+		if err != nil {
+			return LispFalse, err
+		}
+		fill := LispFalse
+		if len(args) > 1 {
+			fill = args[1]
+		}
+		ret := LispNull
+		for i := 0; i < k; i++ {
+			ret = Cons(fill, ret)
+		}
+		return ret, nil
+	})
+	DefinePrimitive("length", 1, 1, func(args ...LObj) (LObj, error) {
+		if !args[0].IsList() {
+			return LispFalse, fmt.Errorf("length: not list: %s", args[0].shortString())
+		}
+		n, err := args[0].Length()
+		return NewNumber(n), err
+	})
+	// all lists but the last are copied, the last one can be any object
+	DefineAllocator("append", 0, -1, listsCost, func(args ...LObj) (LObj, error) {
+		if len(args) == 0 {
+			return LispNull, nil
+		}
+		ret := args[len(args)-1]
+		for i := len(args) - 2; i >= 0; i-- {
+			elems, err := listElems("append", args[i])
+			if err != nil {
+				return LispFalse, err
+			}
+			for k := len(elems) - 1; k >= 0; k-- {
+				ret = Cons(elems[k], ret)
+			}
+		}
+		return ret, nil
+	})
+	DefineAllocator("reverse", 1, 1, listsCost, func(args ...LObj) (LObj, error) {
+		elems, err := listElems("reverse", args[0])
+		if err != nil {
+			return LispFalse, err
+		}
+		ret := LispNull
+		for _, elem := range elems {
+			ret = Cons(elem, ret)
+		}
+		return ret, nil
+	})
+	DefineAllocator("list-copy", 1, 1, listsCost, func(args ...LObj) (LObj, error) {
+		if args[0].listEnd() == nil {
+			return LispFalse, fmt.Errorf("list-copy: circular list")
+		}
+		// improper tail is shared
+		elems := make([]LObj, 0)
+		elem := &args[0]
+		for ; elem.IsPair(); elem = elem.Cdr {
+			elems = append(elems, *elem.Car)
+		}
+		ret := *elem
+		for i := len(elems) - 1; i >= 0; i-- {
+			ret = Cons(elems[i], ret)
+		}
+		return ret, nil
+	})
+	// walks are bounded by the pairs of list, it must not be circular
+	DefinePrimitive("list-tail", 2, 2, func(args ...LObj) (LObj, error) {
+		k, err := indexArg("list-tail", args, 1, int(^uint(0)>>1))
+		if err != nil {
+			return LispFalse, err
+		}
+		if args[0].listEnd() == nil {
+			return LispFalse, fmt.Errorf("list-tail: circular list")
+		}
+		obj := args[0]
+		for ; k > 0; k-- {
+			if !obj.IsPair() {
+				return LispFalse, fmt.Errorf("list-tail: index out of range: %v", args[1])
+			}
+			obj = *obj.Cdr
+		}
+		return obj, nil
+	})
+	DefinePrimitive("list-ref", 2, 2, func(args ...LObj) (LObj, error) {
+		k, err := indexArg("list-ref", args, 1, int(^uint(0)>>1))
+		if err != nil {
+			return LispFalse, err
+		}
+		if args[0].listEnd() == nil {
+			return LispFalse, fmt.Errorf("list-ref: circular list")
+		}
+		return args[0].ListRef(k)
+	})
+
+	// searching
+	DefinePrimitive("memq", 2, 2, func(args ...LObj) (LObj, error) {
+		return member("memq", args[0], args[1], func(x, y LObj) (bool, error) { return x.Eq(&y), nil })
+	})
+	DefinePrimitive("memv", 2, 2, func(args ...LObj) (LObj, error) {
+		return member("memv", args[0], args[1], func(x, y LObj) (bool, error) { return x.Eqv(&y), nil })
+	})
+	// (member x list [compare])
+	DefineVMPrimitive("member", 2, 3, func(vm *VM, args ...LObj) (LObj, error) {
+		var compare *LObj
+		if len(args) > 2 {
+			compare = &args[2]
+		}
+		return member("member", args[0], args[1], equivalence(vm, compare))
+	})
+	DefinePrimitive("assq", 2, 2, func(args ...LObj) (LObj, error) {
+		return assoc("assq", args[0], args[1], func(x, y LObj) (bool, error) { return x.Eq(&y), nil })
+	})
+	DefinePrimitive("assv", 2, 2, func(args ...LObj) (LObj, error) {
+		return assoc("assv", args[0], args[1], func(x, y LObj) (bool, error) { return x.Eqv(&y), nil })
+	})
+	// (assoc x alist [compare])
+	DefineVMPrimitive("assoc", 2, 3, func(vm *VM, args ...LObj) (LObj, error) {
+		var compare *LObj
+		if len(args) > 2 {
+			compare = &args[2]
+		}
+		return assoc("assoc", args[0], args[1], equivalence(vm, compare))
+	})
+
+	// (map proc list1 list2 ...), as long as the shortest list
+	DefineVMPrimitive("map", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		return mapLists(vm, "map", args, true)
+	})
+	DefineVMPrimitive("for-each", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		return mapLists(vm, "for-each", args, false)
+	})
+
+	DefineLibrary("(scheme base)",
+		"set-car!", "set-cdr!", "caar", "cadr", "cdar", "cddr",
+		"list?", "make-list", "length", "append", "reverse", "list-copy", "list-tail", "list-ref",
+		"memq", "memv", "member", "assq", "assv", "assoc", "map", "for-each")
+}
@@ -2,10 +2,35 @@ package rgors
 
 import (
 	"fmt"
+	"io"
 )
 
 type Parser struct {
 	Lexer
+	Source SourceMap // positions of lists read by Program
+}
+
+// SourceMap maps list to its position in source.
+// key is Car of the pair, which identifies the list.
+type SourceMap map[*LObj]Position
+
+// position of list x
+func (source SourceMap) Position(x *LObj) (Position, bool) {
+	if !x.IsPair() || source == nil {
+		return Position{}, false
+	}
+	pos, ok := source[x.Car]
+	return pos, ok
+}
+
+// record position of list x
+func (p *Parser) mark(x LObj, pos Position) {
+	if x.IsPair() {
+		if p.Source == nil {
+			p.Source = make(SourceMap)
+		}
+		p.Source[x.Car] = pos
+	}
 }
 
 type UnclosedError struct {
@@ -21,7 +46,18 @@ func (p *Parser) match(kind int) error {
 	}
 }
 
+// ReadToken skips comments and directives
+func (p *Parser) ReadToken() (Token, error) {
+	for {
+		token, err := p.Lexer.ReadToken()
+		if err != nil || token.Kind != Comment {
+			return token, err
+		}
+	}
+}
+
 func (p *Parser) Start() error {
+	p.Source = make(SourceMap)
 	_, err := p.ReadToken()
 	return err
 }
@@ -50,8 +86,11 @@ func (p *Parser) Datum() (LObj, error) {
 	case Boolean, Number, Char, String, Ident:
 		return p.SimpleDatum()
 	case Open:
+		pos := p.Token.Position
 		p.match(Open) // consume open
-		return p.Pair()
+		pair, err := p.Pair()
+		p.mark(pair, pos)
+		return pair, err
 	case OpenVec:
 		p.match(OpenVec) // consume openvec
 		return p.Vector()
@@ -79,9 +118,9 @@ func (p *Parser) SimpleDatum() (LObj, error) {
 	case Number:
 		obj = LObj{Type: DTNumber, Value: p.Token.Value}
 	case Char:
-		obj = LObj{Type: DTChar, Value: p.Token.Value}
+		obj = NewChar(p.Token.Value.(rune))
 	case String:
-		obj = LObj{Type: DTString, Value: p.Token.Value}
+		obj = NewString(p.Token.Value.(string))
 	default:
 		obj = *NewSymbol(p.Token.Value.(string))
 	}
@@ -95,7 +134,7 @@ func (p *Parser) Vector() (LObj, error) {
 		switch p.Token.Kind {
 		case Close:
 			p.match(Close)
-			return LObj{Type: DTVector, Value: vec}, nil
+			return NewVector(vec...), nil
 		case EOF:
 			return LObj{}, &UnclosedError{Text: "vector"}
 		default:
@@ -175,6 +214,12 @@ func (p *Parser) ParseFile(name string) ([]LObj, error) {
 	return p.Program()
 }
 
+func (p *Parser) ParseReader(name string, r io.Reader) ([]LObj, error) {
+	p.SetReader(name, r)
+	p.Start()
+	return p.Program()
+}
+
 func (p *Parser) ParseString(s string) ([]LObj, error) {
 	p.SetString(s)
 	p.Start()
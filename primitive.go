@@ -0,0 +1,309 @@
+package rgors
+
+import (
+	"fmt"
+)
+
+// built in procedure
+// Max < 0 means variadic
+//
+// VMFn gets the running VM, it can apply Scheme procedures by
+// vm.Call and return, or return vm.TailCall to be replaced by a procedure.
+type Primitive struct {
+	Name string
+	Min  int
+	Max  int
+	Fn   func(args ...LObj) (LObj, error)
+	Cost func(args []LObj) int                    // approximate bytes allocated, nil if none
+	VMFn func(vm *VM, args ...LObj) (LObj, error) // used instead of Fn if not nil
+}
+
+func NewPrimitive(name string, min, max int, fn func(args ...LObj) (LObj, error)) LObj {
+	return LObj{
+		Type:  DTPrimitive,
+		Value: &Primitive{Name: name, Min: min, Max: max, Fn: fn},
+	}
+}
+
+// register primitive, it is bound in DefaultEnvironment
+func DefinePrimitive(name string, min, max int, fn func(args ...LObj) (LObj, error)) {
+	registerPrimitive(name, NewPrimitive(name, min, max, fn))
+}
+
+// register allocating primitive, cost is counted against VM.MaxHeap
+func DefineAllocator(name string, min, max int, cost func(args []LObj) int, fn func(args ...LObj) (LObj, error)) {
+	prim := NewPrimitive(name, min, max, fn)
+	prim.Value.(*Primitive).Cost = cost
+	registerPrimitive(name, prim)
+}
+
+// primitive which needs the running VM
+func NewVMPrimitive(name string, min, max int, fn func(vm *VM, args ...LObj) (LObj, error)) LObj {
+	return LObj{
+		Type:  DTPrimitive,
+		Value: &Primitive{Name: name, Min: min, Max: max, VMFn: fn},
+	}
+}
+
+// register primitive which needs the running VM
+func DefineVMPrimitive(name string, min, max int, fn func(vm *VM, args ...LObj) (LObj, error)) {
+	registerPrimitive(name, NewVMPrimitive(name, min, max, fn))
+}
+
+func registerPrimitive(name string, prim LObj) {
+	registry.Lock()
+	primitives[name] = prim
+	registry.Unlock()
+	DefineGlobal(name, prim)
+}
+
+// (quote prim) for syntax expansions, so they work whatever name is
+// bound at the use site
+func primitiveRef(name string) LObj {
+	registry.RLock()
+	defer registry.RUnlock()
+	return NewList(*NewSymbol("quote"), primitives[name])
+}
+
+func init() {
+	DefinePrimitive("+", 0, -1, func(args ...LObj) (LObj, error) {
+		return foldNumbers("+", NewNumber(0), args, addNumber)
+	})
+	DefinePrimitive("*", 0, -1, func(args ...LObj) (LObj, error) {
+		return foldNumbers("*", NewNumber(1), args, mulNumber)
+	})
+	DefinePrimitive("-", 1, -1, func(args ...LObj) (LObj, error) {
+		if len(args) == 1 {
+			return foldNumbers("-", NewNumber(0), args, subNumber)
+		}
+		return foldNumbers("-", args[0], args[1:], subNumber)
+	})
+	DefinePrimitive("/", 1, -1, func(args ...LObj) (LObj, error) {
+		if len(args) == 1 {
+			return foldNumbers("/", NewNumber(1), args, divNumber)
+		}
+		return foldNumbers("/", args[0], args[1:], divNumber)
+	})
+	DefinePrimitive("=", 1, -1, func(args ...LObj) (LObj, error) {
+		return compareNumbers("=", args, func(c int) bool { return c == 0 })
+	})
+	DefinePrimitive("<", 1, -1, func(args ...LObj) (LObj, error) {
+		return compareNumbers("<", args, func(c int) bool { return c < 0 })
+	})
+	DefinePrimitive(">", 1, -1, func(args ...LObj) (LObj, error) {
+		return compareNumbers(">", args, func(c int) bool { return c > 0 })
+	})
+	DefinePrimitive("<=", 1, -1, func(args ...LObj) (LObj, error) {
+		return compareNumbers("<=", args, func(c int) bool { return c <= 0 })
+	})
+	DefinePrimitive(">=", 1, -1, func(args ...LObj) (LObj, error) {
+		return compareNumbers(">=", args, func(c int) bool { return c >= 0 })
+	})
+
+	// pairs
+	DefineAllocator("cons", 2, 2, func(args []LObj) int { return 2 * objSize }, func(args ...LObj) (LObj, error) {
+		return Cons(args[0], args[1]), nil
+	})
+	DefinePrimitive("car", 1, 1, func(args ...LObj) (LObj, error) {
+		return args[0].SafeCar()
+	})
+	DefinePrimitive("cdr", 1, 1, func(args ...LObj) (LObj, error) {
+		return args[0].SafeCdr()
+	})
+	DefineAllocator("list", 0, -1, listCost, func(args ...LObj) (LObj, error) {
+		return NewList(args...), nil
+	})
+
+	// predicates
+	DefinePrimitive("null?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].IsNull()), nil
+	})
+	DefinePrimitive("pair?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].IsPair()), nil
+	})
+	DefinePrimitive("eq?", 2, 2, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Eq(&args[1])), nil
+	})
+	DefinePrimitive("eqv?", 2, 2, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Eqv(&args[1])), nil
+	})
+	DefinePrimitive("equal?", 2, 2, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Equal(&args[1])), nil
+	})
+	DefinePrimitive("not", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(!args[0].ToBool()), nil
+	})
+	DefinePrimitive("eof-object", 0, 0, func(args ...LObj) (LObj, error) {
+		return LispEOF, nil
+	})
+	DefinePrimitive("eof-object?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Type == DTEOF), nil
+	})
+	// (apply proc arg ... list), proc is applied as a tail call
+	DefineVMPrimitive("apply", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		if !args[0].IsProcedure() {
+			return LispFalse, fmt.Errorf("apply: not procedure: %v", args[0])
+		}
+		last := args[len(args)-1]
+		if !last.IsList() {
+			return LispFalse, fmt.Errorf("apply: not list: %s", last.shortString())
+		}
+		spread := append([]LObj(nil), args[1:len(args)-1]...)
+		for elem := &last; elem.IsPair(); elem = elem.Cdr {
+			spread = append(spread, *elem.Car)
+		}
+		return vm.TailCall(args[0], spread...)
+	})
+	// (values obj ...), one value is returned as it is
+	DefineAllocator("values", 0, -1, func(args []LObj) int {
+		return len(args) * objSize
+	}, func(args ...LObj) (LObj, error) {
+		if len(args) == 1 {
+			return args[0], nil
+		}
+		return LObj{Type: DTValues, Value: append([]LObj(nil), args...)}, nil
+	})
+	// (call-with-values producer consumer), consumer is applied as a tail call
+	DefineVMPrimitive("call-with-values", 2, 2, func(vm *VM, args ...LObj) (LObj, error) {
+		if !args[1].IsProcedure() {
+			return LispFalse, fmt.Errorf("call-with-values: not procedure: %v", args[1])
+		}
+		v, err := vm.Call(args[0])
+		if err != nil {
+			return LispFalse, err
+		}
+		if v.Type == DTValues {
+			return vm.TailCall(args[1], v.Value.([]LObj)...)
+		}
+		return vm.TailCall(args[1], v)
+	})
+
+	DefineLibrary("(scheme base)",
+		"+", "*", "-", "/", "=", "<", ">", "<=", ">=",
+		"cons", "car", "cdr", "list", "null?", "pair?", "eq?", "eqv?", "equal?", "not",
+		"eof-object", "eof-object?", "apply", "values", "call-with-values")
+}
+
+// car and cdr of each pair are allocated
+func listCost(args []LObj) int {
+	return len(args) * 2 * objSize
+}
+
+// numbers
+// Value is int or float64
+
+func NewNumber(n interface{}) LObj {
+	return LObj{Type: DTNumber, Value: n}
+}
+
+func NewBoolean(b bool) LObj {
+	if b {
+		return LispTrue
+	}
+	return LispFalse
+}
+
+func toFloat(obj LObj) float64 {
+	if i, ok := obj.Value.(int); ok {
+		return float64(i)
+	}
+	return obj.Value.(float64)
+}
+
+func foldNumbers(name string, acc LObj, args []LObj, op func(x, y LObj) (LObj, error)) (LObj, error) {
+	var err error
+	for _, arg := range args {
+		if !arg.IsNumber() {
+			return LispFalse, fmt.Errorf("%s: not number: %v", name, arg)
+		}
+		if acc, err = op(acc, arg); err != nil {
+			return LispFalse, err
+		}
+	}
+	return acc, nil
+}
+
+func addNumber(x, y LObj) (LObj, error) {
+	i, iok := x.Value.(int)
+	j, jok := y.Value.(int)
+	if iok && jok {
+		return NewNumber(i + j), nil
+	}
+	return NewNumber(toFloat(x) + toFloat(y)), nil
+}
+
+func subNumber(x, y LObj) (LObj, error) {
+	i, iok := x.Value.(int)
+	j, jok := y.Value.(int)
+	if iok && jok {
+		return NewNumber(i - j), nil
+	}
+	return NewNumber(toFloat(x) - toFloat(y)), nil
+}
+
+func mulNumber(x, y LObj) (LObj, error) {
+	i, iok := x.Value.(int)
+	j, jok := y.Value.(int)
+	if iok && jok {
+		return NewNumber(i * j), nil
+	}
+	return NewNumber(toFloat(x) * toFloat(y)), nil
+}
+
+// exact result only when divisible
+func divNumber(x, y LObj) (LObj, error) {
+	i, iok := x.Value.(int)
+	j, jok := y.Value.(int)
+	if iok && jok {
+		if j == 0 {
+			return LispFalse, fmt.Errorf("/: division by zero")
+		}
+		if i%j == 0 {
+			return NewNumber(i / j), nil
+		}
+	}
+	return NewNumber(toFloat(x) / toFloat(y)), nil
+}
+
+// compare adjacent arguments
+func compareNumbers(name string, args []LObj, pred func(int) bool) (LObj, error) {
+	for _, arg := range args {
+		if !arg.IsNumber() {
+			return LispFalse, fmt.Errorf("%s: not number: %v", name, arg)
+		}
+	}
+	for k := 0; k+1 < len(args); k++ {
+		var c int
+		i, iok := args[k].Value.(int)
+		j, jok := args[k+1].Value.(int)
+		if iok && jok {
+			c = compareInt(i, j)
+		} else {
+			c = compareFloat(toFloat(args[k]), toFloat(args[k+1]))
+		}
+		if !pred(c) {
+			return LispFalse, nil
+		}
+	}
+	return LispTrue, nil
+}
+
+func compareInt(i, j int) int {
+	switch {
+	case i < j:
+		return -1
+	case i > j:
+		return 1
+	}
+	return 0
+}
+
+func compareFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
@@ -3,6 +3,8 @@ package rgors
 import (
 	"fmt"
 	"github.com/chzyer/readline"
+	"os"
+	"strings"
 )
 
 func display(p *Parser, line string) {
@@ -19,6 +21,102 @@ func display(p *Parser, line string) {
 	fmt.Println("------------Lexer")
 }
 
+// ,trace [calls|all|off]
+// ,debug [on|off|step]
+// ,break <proc|line|file:line>  ,delete <n>  ,breaks
+// ,load <file>
+func command(vm *VM, dbg *Debugger, args []string) {
+	if len(args) == 0 {
+		fmt.Println("commands: ,trace [calls|all|off] ,debug [on|off|step]")
+		fmt.Println("          ,break <proc|line|file:line> ,delete <n> ,breaks ,load <file>")
+		return
+	}
+	switch args[0] {
+	case "trace":
+		mode := "calls"
+		if len(args) > 1 {
+			mode = args[1]
+		}
+		switch mode {
+		case "calls":
+			vm.Tracer = &CallTracer{Out: os.Stdout}
+		case "all":
+			vm.Tracer = &DumpTracer{Out: os.Stdout}
+		case "off":
+			vm.Tracer = nil
+		default:
+			fmt.Println("trace: unknown mode", mode)
+		}
+	case "debug":
+		mode := "on"
+		if len(args) > 1 {
+			mode = args[1]
+		}
+		switch mode {
+		case "on":
+			vm.Tracer = dbg
+		case "step": // pause at the next expression
+			vm.Tracer = dbg
+			dbg.Step()
+		case "off":
+			vm.Tracer = nil
+		default:
+			fmt.Println("debug: unknown mode", mode)
+		}
+	case "break":
+		if err := dbg.Break(strings.Join(args[1:], " ")); err != nil {
+			fmt.Println(err)
+			return
+		}
+		vm.Tracer = dbg
+	case "delete":
+		n := 0
+		if len(args) > 1 {
+			fmt.Sscan(args[1], &n)
+		}
+		if err := dbg.Delete(n); err != nil {
+			fmt.Println(err)
+		}
+	case "breaks":
+		dbg.listBreaks()
+	case "load":
+		if len(args) < 2 {
+			fmt.Println("load: no file")
+			return
+		}
+		if err := load(vm, args[1]); err != nil {
+			fmt.Println("load:", err)
+		}
+	default:
+		fmt.Println("unknown command:", args[0])
+	}
+}
+
+// evaluate all expressions in file
+func load(vm *VM, name string) error {
+	fp, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	p := Parser{}
+	program, err := p.ParseReader(name, fp)
+	if err != nil {
+		return err
+	}
+	for _, expr := range program {
+		code, err := expr.CompileSource(p.Source)
+		if err != nil {
+			return err
+		}
+		vm.Load(code)
+		if _, err = vm.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func Repl() {
 	var line string
 	var err error
@@ -31,6 +129,13 @@ func Repl() {
 	}
 
 	p := Parser{}
+	vm := NewVM()
+	dbg := &Debugger{Out: os.Stdout}
+	dbg.In = func() (string, error) {
+		rl.SetPrompt("debug> ")
+		defer rl.SetPrompt("rgors> ")
+		return rl.Readline()
+	}
 
 	for {
 
@@ -47,6 +152,12 @@ func Repl() {
 			break
 		}
 
+		// repl command
+		if strings.HasPrefix(strings.TrimSpace(line), ",") {
+			command(vm, dbg, strings.Fields(strings.TrimSpace(line)[1:]))
+			continue
+		}
+
 		// lexer check
 		// display(&p, line)
 		// parse
@@ -63,23 +174,23 @@ func Repl() {
 			}
 		}
 		// eval???
-		vm := NewVM()
 		for _, expr := range program {
-			comp, err := expr.Compile()
+			code, err := expr.CompileSource(p.Source)
 			if err != nil {
 				fmt.Println("compile error:", err.Error())
 				continue
 			}
-			fmt.Println(comp)
+			fmt.Print(code)
 
 			// eval!!
-			vm.Load(comp)
+			vm.Load(code)
 			ans, err := vm.Run()
+			dbg.Continue()
 			if err != nil {
 				fmt.Println("vm error:", err.Error())
 				continue
 			}
-			fmt.Println("=>", comp, "\n=>", ans)
+			fmt.Println("=>", ans)
 		}
 	}
 }
@@ -1,8 +1,15 @@
 package rgors
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestParser(t *testing.T) {
@@ -36,8 +43,8 @@ func TestEq(t *testing.T) {
 
 	s1, _ := parser.str2expr("\"hello\"")
 	s2, _ := parser.str2expr("\"hello\"")
-	if !s1.Eq(&s2) {
-		t.Error("fail: str compare: %v != %v", s1, s2)
+	if s1.Eq(&s2) { // strings are mutable
+		t.Errorf("fail: str compare: %v != %v", s1, s2)
 	}
 
 	a := NewSymbol("a")
@@ -46,7 +53,58 @@ func TestEq(t *testing.T) {
 	cns1 := Cons(*a, *b)
 	cns2 := Cons(*a, *b)
 	if cns1.Eq(&cns2) {
-		t.Error("fail: cons compare: %v != %v", cns1, cns2)
+		t.Errorf("fail: cons compare: %v != %v", cns1, cns2)
+	}
+
+	v1 := NewVector(NewNumber(1))
+	v2 := NewVector(NewNumber(1))
+	v3 := v1
+	if v1.Eq(&v2) || !v1.Eq(&v3) {
+		t.Errorf("fail: vector compare: %v %v", v1, v2)
+	}
+}
+
+func TestEquivalence(t *testing.T) {
+	checkEval(t, []struct{ src, expect string }{
+		{`(list (eq? 'a 'a) (eq? '() '()) (eq? car car) (eq? "a" "a") (eq? (list 1) (list 1)))`,
+			"(#t #t #t #f #f)"},
+		{`(define v (vector 1))
+(define s (string #\a))
+(list (eq? v v) (eq? s s) (eq? (vector) (vector 1)))`, "(#t #t #f)"},
+		{`(list (eqv? 2 2) (eqv? 2 2.0) (eqv? 1.5 1.5) (eqv? #\a #\a) (eqv? "" "") (eqv? 0.0 (* -1 0.0)))`,
+			"(#t #f #t #t #f #f)"},
+		{`(list (equal? '(1 (2 #(3 "x"))) (list 1 (list 2 (vector 3 (string #\x)))))
+      (equal? "abc" "abd") (equal? #(1 2) #(1 2 3)) (equal? 2 2.0) (equal? '() '()))`,
+			"(#t #f #f #f #t)"},
+	})
+	// cycles
+	a := NewList(NewNumber(1), NewNumber(2))
+	a.Cdr.Cdr = &a
+	b := NewList(NewNumber(1), NewNumber(2), NewNumber(1), NewNumber(2))
+	b.Cdr.Cdr.Cdr.Cdr = &b
+	c := NewList(NewNumber(1), NewNumber(3))
+	c.Cdr.Cdr = &c
+	if !a.Equal(&b) || a.Equal(&c) {
+		t.Errorf("fail: cyclic list compare")
+	}
+	v := NewVector(NewNumber(1), LispNull)
+	v.Value.([]LObj)[1] = v
+	w := NewVector(NewNumber(1), LispNull)
+	w.Value.([]LObj)[1] = w
+	if !v.Equal(&w) {
+		t.Errorf("fail: cyclic vector compare")
+	}
+	// foreign objects by hook
+	type point struct{ x, y int }
+	ft, err := registerTestType("equal-point", &point{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft.Equal = func(a, b interface{}) bool { return *a.(*point) == *b.(*point) }
+	p1, _ := NewForeign(&point{1, 2})
+	p2, _ := NewForeign(&point{1, 2})
+	if p1.Eq(&p2) || !p1.Equal(&p2) {
+		t.Errorf("fail: foreign compare: %v %v", p1, p2)
 	}
 }
 
@@ -112,13 +170,1633 @@ func TestList(t *testing.T) {
 
 func TestLookup(t *testing.T) {
 	parser := Parser{}
-	vars, _ := parser.str2expr("(a b c)")
-	vals, _ := parser.str2expr("(1 2 3)")
-	env := LispNull.Extend(vars, vals)
-	fmt.Println(env)
-	fmt.Println(env.LookUp(NewSymbol("c")))
-	fmt.Println(env)
-	newvals, _ := env.LookUp(NewSymbol("c"))
-	newvals.SetCar(LispFalse)
-	fmt.Println(env)
+	locals, _ := parser.str2expr("(a b c)")
+	frees, _ := parser.str2expr("(d e)")
+	env := Cons(locals, frees)
+	var expects map[string][2]int = map[string][2]int{
+		"a": {LocalVar, 0},
+		"c": {LocalVar, 2},
+		"e": {FreeVar, 1},
+		"z": {GlobalVar, 0},
+	}
+	for name, expect := range expects {
+		kind, n := env.CompileLookUp(NewSymbol(name))
+		if kind != expect[0] || n != expect[1] {
+			t.Errorf("%s: expect %v, but %d %d", name, expect, kind, n)
+		}
+	}
+
+	body, _ := parser.str2expr("((lambda (x) (set! a x) (set! d 'q)) (f b d))")
+	if free := body.FindFreeBody(locals); free.String() != "(f d)" {
+		t.Errorf("find free fail: %v", free)
+	}
+	if sets := body.FindSetsBody(locals); sets.String() != "(a)" {
+		t.Errorf("find sets fail: %v", sets)
+	}
+}
+
+// compile and run each expression, return the last value
+func evalString(s string) (LObj, error) {
+	parser := Parser{}
+	program, err := parser.ParseString(s)
+	if err != nil {
+		return LispFalse, err
+	}
+	vm := NewVM()
+	ans := LispFalse
+	for _, expr := range program {
+		code, err := expr.Compile()
+		if err != nil {
+			return LispFalse, err
+		}
+		vm.Load(code)
+		if ans, err = vm.Run(); err != nil {
+			return ans, err
+		}
+	}
+	return ans, nil
+}
+
+func TestVM(t *testing.T) {
+	var programs map[string]string = map[string]string{
+		"((lambda (x) x) 1)":                        "1",
+		"((lambda (x y) (if x y 0)) #f 2)":          "0",
+		"((lambda (x) (set! x 5) x) 1)":             "5",
+		"(((lambda (x) (lambda () x)) 'closed))":    "closed",
+		"(+ 1 (call/cc (lambda (k) (+ 10 (k 2)))))": "3",
+		"(define x 10) (set! x (* x 2)) x":          "20",
+		`(define counter ((lambda (n) (lambda () (set! n (+ n 1)) n)) 0))
+		 (counter) (counter) (counter)`: "3",
+		"((lambda (x) ((lambda () (set! x 'inner))) x) 'outer)":    "inner",
+		"((lambda (a b) ((lambda (k) (k a)) (lambda (x) b))) 1 2)": "2",
+		"((lambda (x) (call/cc (lambda (k) (k x)))) 'tail)":        "tail",
+		`(define k #f)
+		 ((lambda (v) (if (< v 3) (k (+ v 1)) v))
+		  (call/cc (lambda (c) (set! k c) 0)))`: "3",
+		"(define (f n) (if (< n 1) 'done (f (- n 1)))) (f 100)": "done",
+		`(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))
+		 (fib 10)`: "55",
+	}
+	for src, expect := range programs {
+		ans, err := evalString(src)
+		if err != nil {
+			t.Errorf("%s: %s", src, err)
+			continue
+		}
+		if ans.String() != expect {
+			t.Errorf("%s: expect %s, but %v", src, expect, ans)
+		}
+	}
+
+	for _, src := range []string{"undefined-variable", "(1 2)", "((lambda (x) x))"} {
+		if _, err := evalString(src); err == nil {
+			t.Errorf("%s: should fail", src)
+		}
+	}
+}
+
+// fib(25) by self application, so the list-walking VM can run it too
+func BenchmarkFib(b *testing.B) {
+	src := `((lambda (fib) (fib fib 25)) (lambda (f n) (if (< n 2) n (+ (f f (- n 1)) (f f (- n 2))))))`
+	for i := 0; i < b.N; i++ {
+		if ans, err := evalString(src); err != nil || ans.String() != "75025" {
+			b.Fatal(ans, err)
+		}
+	}
+}
+
+func TestFoldCase(t *testing.T) {
+	parser := Parser{}
+	program, err := parser.ParseString("Foo #!fold-case Foo BAR #!no-fold-case Bar")
+	if err != nil {
+		t.Fatalf("parser fail: %s", err)
+	}
+	expects := []string{"Foo", "foo", "bar", "Bar"}
+	if len(program) != len(expects) {
+		t.Fatalf("expect %d data, but %d", len(expects), len(program))
+	}
+	for i, expect := range expects {
+		if !program[i].Eq(NewSymbol(expect)) {
+			t.Errorf("expect %s, but %v", expect, program[i])
+		}
+	}
+
+	parser.FoldCase = true
+	sym, _ := parser.str2expr("HeLLo")
+	if !sym.Eq(NewSymbol("hello")) {
+		t.Errorf("expect hello, but %v", sym)
+	}
+
+	if _, err := parser.ParseString("#!unknown a"); err == nil {
+		t.Errorf("unknown directive should fail")
+	}
+}
+
+func TestIdentifier(t *testing.T) {
+	parser := Parser{}
+	var idents map[string]string = map[string]string{
+		"|foo bar|":    "foo bar",
+		"|a\\|b|":      "a|b",
+		"|\\x41;bc|":   "Abc",
+		"|1abc|":       "1abc",
+		"||":           "",
+		"->x":          "->x",
+		"+.foo":        "+.foo",
+		"..":           "..",
+		"...":          "...",
+		".foo":         ".foo",
+		"-":            "-",
+		"+":            "+",
+		"list->vector": "list->vector",
+	}
+	for src, expect := range idents {
+		sym, err := parser.str2expr(src)
+		if err != nil {
+			t.Errorf("parser fail: %s: %s", src, err)
+			continue
+		}
+		if !sym.Eq(NewSymbol(expect)) {
+			t.Errorf("expect %q, but %q", expect, sym.Value)
+		}
+		// printed symbol reads back
+		again, err := parser.str2expr(sym.String())
+		if err != nil || !again.Eq(&sym) {
+			t.Errorf("%q does not re-read: %v", sym.String(), err)
+		}
+	}
+
+	for _, src := range []string{"+.", "+5x"} {
+		if program, err := parser.ParseString(src); err == nil && len(program) == 1 && program[0].IsSymbol() {
+			t.Errorf("%s should not be identifier", src)
+		}
+	}
+
+	var printed map[string]string = map[string]string{
+		"abc":     "abc",
+		"foo bar": "|foo bar|",
+		"1abc":    "|1abc|",
+		"+1":      "|+1|",
+		"":        "||",
+		"a|b":     "|a\\|b|",
+		".":       "|.|",
+	}
+	for name, expect := range printed {
+		if s := NewSymbol(name).String(); s != expect {
+			t.Errorf("expect %s, but %s", expect, s)
+		}
+	}
+}
+
+// benchmark programs
+// src is definitions, main is measured expression
+type benchProgram struct {
+	name   string
+	src    string
+	main   string
+	expect string
+}
+
+var benchPrograms = []benchProgram{
+	{
+		name: "fib",
+		src: `
+(define (fib n)
+  (if (< n 2)
+      n
+      (+ (fib (- n 1)) (fib (- n 2)))))`,
+		main:   "(fib 25)",
+		expect: "75025",
+	},
+	{
+		name: "tak",
+		src: `
+(define (tak x y z)
+  (if (not (< y x))
+      z
+      (tak (tak (- x 1) y z)
+           (tak (- y 1) z x)
+           (tak (- z 1) x y))))`,
+		main:   "(tak 18 12 6)",
+		expect: "7",
+	},
+	{
+		name: "nqueens",
+		src: `
+(define (one-to n) (one-to-loop n '()))
+(define (one-to-loop i l)
+  (if (= i 0) l (one-to-loop (- i 1) (cons i l))))
+(define (app x y)
+  (if (null? x) y (cons (car x) (app (cdr x) y))))
+(define (ok? row dist placed)
+  (if (null? placed)
+      #t
+      (if (= (car placed) (+ row dist))
+          #f
+          (if (= (car placed) (- row dist))
+              #f
+              (ok? row (+ dist 1) (cdr placed))))))
+(define (try-it x y z)
+  (if (null? x)
+      (if (null? y) 1 0)
+      (+ (if (ok? (car x) 1 z)
+             (try-it (app (cdr x) y) '() (cons (car x) z))
+             0)
+         (try-it (cdr x) (cons (car x) y) z))))
+(define (queens n) (try-it (one-to n) '() '()))`,
+		main:   "(queens 8)",
+		expect: "92",
+	},
+	{
+		name: "deriv",
+		src: `
+(define (map1 f l)
+  (if (null? l) '() (cons (f (car l)) (map1 f (cdr l)))))
+(define (deriv a)
+  (if (not (pair? a))
+      (if (eq? a 'x) 1 0)
+      (if (eq? (car a) '+)
+          (cons '+ (map1 deriv (cdr a)))
+          (if (eq? (car a) '-)
+              (cons '- (map1 deriv (cdr a)))
+              (if (eq? (car a) '*)
+                  (list '* a
+                        (cons '+ (map1 (lambda (a) (list '/ (deriv a) a)) (cdr a))))
+                  (list '-
+                        (list '/ (deriv (car (cdr a))) (car (cdr (cdr a))))
+                        (list '/ (car (cdr a))
+                              (list '* (car (cdr (cdr a))) (car (cdr (cdr a)))
+                                    (deriv (car (cdr (cdr a))))))))))))
+(define (deriv-loop n r)
+  (if (= n 0)
+      r
+      (deriv-loop (- n 1) (deriv '(+ (* 3 x x) (* a x x) (* b x) 5)))))`,
+		main:   "(deriv-loop 1000 #f)",
+		expect: "(+ (* (* 3 x x) (+ (/ 0 3) (/ 1 x) (/ 1 x))) (* (* a x x) (+ (/ 0 a) (/ 1 x) (/ 1 x))) (* (* b x) (+ (/ 0 b) (/ 1 x))) 0)",
+	},
+	{
+		name: "string",
+		src: `
+(define (build n s)
+  (if (= n 0)
+      s
+      (build (- n 1) (string-append s (number->string n)))))`,
+		main:   `(string-length (build 1000 ""))`,
+		expect: "2893",
+	},
+}
+
+func BenchmarkLexer(b *testing.B) {
+	for _, prog := range benchPrograms {
+		b.Run(prog.name, func(b *testing.B) {
+			b.ReportAllocs()
+			lexer := Lexer{}
+			for i := 0; i < b.N; i++ {
+				lexer.SetString(prog.src + prog.main)
+				tokens, err := lexer.ReadTokens()
+				if tokens[len(tokens)-1].Kind != EOF {
+					b.Fatalf("lexer fail: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParser(b *testing.B) {
+	for _, prog := range benchPrograms {
+		b.Run(prog.name, func(b *testing.B) {
+			b.ReportAllocs()
+			parser := Parser{}
+			for i := 0; i < b.N; i++ {
+				parser.SetString(prog.src + prog.main)
+				parser.Start()
+				if _, err := parser.Program(); err != nil {
+					b.Fatalf("parser fail: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompile(b *testing.B) {
+	for _, prog := range benchPrograms {
+		b.Run(prog.name, func(b *testing.B) {
+			parser := Parser{}
+			program, err := parser.ParseString(prog.src + prog.main)
+			if err != nil {
+				b.Fatalf("parser fail: %s", err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, expr := range program {
+					if _, err := expr.Compile(); err != nil {
+						b.Fatalf("compile fail: %s", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRun(b *testing.B) {
+	for _, prog := range benchPrograms {
+		b.Run(prog.name, func(b *testing.B) {
+			if _, err := evalString(prog.src); err != nil {
+				b.Fatalf("%s: %s", prog.name, err)
+			}
+			parser := Parser{}
+			main, _ := parser.str2expr(prog.main)
+			code, err := main.Compile()
+			if err != nil {
+				b.Fatalf("compile fail: %s", err)
+			}
+			vm := NewVM()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				vm.Load(code)
+				ans, err := vm.Run()
+				if err != nil {
+					b.Fatalf("%s: %s", prog.name, err)
+				}
+				if ans.String() != prog.expect {
+					b.Fatalf("%s: expect %s, but %v", prog.name, prog.expect, ans)
+				}
+			}
+		})
+	}
+}
+
+// count calls and returns
+type countTracer struct {
+	instructions int
+	calls        []string
+	returns      []string
+}
+
+func (t *countTracer) OnInstruction(op int, vm *VM) {
+	t.instructions += 1
+}
+
+func (t *countTracer) OnCall(proc LObj, args []LObj, vm *VM) {
+	t.calls = append(t.calls, Cons(proc, NewList(args...)).String())
+}
+
+func (t *countTracer) OnReturn(value LObj, vm *VM) {
+	t.returns = append(t.returns, value.String())
+}
+
+func TestTracer(t *testing.T) {
+	if _, err := evalString("(define (inc x) (+ x 1))"); err != nil {
+		t.Fatal(err)
+	}
+	parser := Parser{}
+	expr, _ := parser.str2expr("(* 2 (inc 3))")
+	code, _ := expr.Compile()
+	vm := NewVM()
+	tracer := &countTracer{}
+	vm.Tracer = tracer
+	vm.Load(code)
+	if ans, err := vm.Run(); err != nil || ans.String() != "8" {
+		t.Fatalf("expect 8, but %v %v", ans, err)
+	}
+	calls := fmt.Sprint(tracer.calls)
+	if calls != "[(<closure inc> 3) (<primitive +> 3 1) (<primitive *> 2 4)]" {
+		t.Errorf("calls: %s", calls)
+	}
+	if returns := fmt.Sprint(tracer.returns); returns != "[4 8]" {
+		t.Errorf("returns: %s", returns)
+	}
+	if tracer.instructions == 0 {
+		t.Errorf("no instruction traced")
+	}
+}
+
+// run program with debugger reading commands from script
+func debugString(s string, breaks []string, script []string) (string, error) {
+	var out strings.Builder
+	dbg := &Debugger{Out: &out}
+	dbg.In = func() (string, error) {
+		if len(script) == 0 {
+			return "", io.EOF
+		}
+		line := script[0]
+		script = script[1:]
+		return line, nil
+	}
+	for _, spec := range breaks {
+		if err := dbg.Break(spec); err != nil {
+			return "", err
+		}
+	}
+	parser := Parser{}
+	program, err := parser.ParseReader("test.scm", strings.NewReader(s))
+	if err != nil {
+		return "", err
+	}
+	vm := NewVM()
+	vm.Tracer = dbg
+	for _, expr := range program {
+		code, err := expr.CompileSource(parser.Source)
+		if err != nil {
+			return "", err
+		}
+		vm.Load(code)
+		if _, err = vm.Run(); err != nil {
+			return "", err
+		}
+	}
+	return out.String(), nil
+}
+
+func TestDebugger(t *testing.T) {
+	program := `(define (square x) (* x x))
+(define (sum-sq a b)
+  (+ (square a)
+     (square b)))
+(sum-sq 3 4)`
+	out, err := debugString(program, []string{"square"},
+		[]string{"rib", "eval (+ x 100)", "bt", "finish", "delete 1", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"[break] square (test.scm:1)",
+		"x = 4", // arguments are evaluated from the last
+		"104",
+		"#0 square at test.scm:1",
+		"#1 sum-sq at test.scm:4",
+		"#2 <toplevel> at test.scm:5",
+		"=> 16",
+	} {
+		if !strings.Contains(out, expect) {
+			t.Errorf("expect %q in:\n%s", expect, out)
+		}
+	}
+	if strings.Count(out, "[break]") != 1 {
+		t.Errorf("deleted breakpoint hit:\n%s", out)
+	}
+
+	// line breakpoint hits once per entry
+	out, err = debugString(program, []string{"test.scm:4"}, []string{"rib", "c", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(out, "[break] sum-sq (test.scm:4)"); n != 1 {
+		t.Errorf("expect 1 break, but %d:\n%s", n, out)
+	}
+	if !strings.Contains(out, "a = 3\nb = 4") {
+		t.Errorf("rib: %s", out)
+	}
+
+	// stepping over calls stays in the procedure
+	out, err = debugString(program, []string{"sum-sq"}, []string{"next", "next", "next", "next", "next", "next", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "[next] square") {
+		t.Errorf("next entered call:\n%s", out)
+	}
+}
+
+func TestBacktrace(t *testing.T) {
+	program := `(define g (lambda (x) (undefined-proc x)))
+(define (f x)
+  (+ 1 (g x)))
+(f 2)`
+	parser := Parser{}
+	exprs, err := parser.ParseReader("test.scm", strings.NewReader(program))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM()
+	for _, expr := range exprs {
+		code, err := expr.CompileSource(parser.Source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm.Load(code)
+		_, err = vm.Run()
+		if err == nil {
+			continue
+		}
+		rterr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("not RuntimeError: %v", err)
+		}
+		if rterr.Err.Error() != "unbound variable: undefined-proc" {
+			t.Errorf("error: %v", rterr.Err)
+		}
+		trace := fmt.Sprint(rterr.Trace)
+		if trace != "[g at test.scm:1 f at test.scm:3 <toplevel> at test.scm:4]" {
+			t.Errorf("backtrace: %s", trace)
+		}
+		return
+	}
+	t.Error("no error")
+}
+
+func TestRunContext(t *testing.T) {
+	if _, err := evalString("(define (forever) (forever))"); err != nil {
+		t.Fatal(err)
+	}
+	parser := Parser{}
+	expr, _ := parser.str2expr("(forever)")
+	code, _ := expr.Compile()
+
+	vm := NewVM()
+	vm.MaxSteps = 10000
+	vm.Load(code)
+	if _, err := vm.Run(); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expect ErrBudgetExceeded, but %v", err)
+	}
+
+	// budget is enough
+	expr, _ = parser.str2expr("(+ 1 2)")
+	small, _ := expr.Compile()
+	vm.Load(small)
+	if ans, err := vm.Run(); err != nil || ans.String() != "3" {
+		t.Errorf("expect 3, but %v %v", ans, err)
+	}
+
+	vm = NewVM()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	vm.Load(code)
+	if _, err := vm.RunContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect DeadlineExceeded, but %v", err)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	tests := []struct {
+		program string
+		expect  string
+	}{
+		{"(guard (e (#t (error-object-message e))) (car 1))", "\"car: 1 is not pair\""},
+		{"(guard (e ((pair? e) 'pair) ((not (pair? e)) (+ e 1))) (raise 41))", "42"},
+		{"(guard (e ((error-object? e) (error-object-irritants e))) (error \"bad\" 1 2))", "(1 2)"},
+		{"(guard (e (else 'outer)) (guard (e ((pair? e) 'inner)) (raise 'x)))", "outer"},
+		{"(define (safe-div a b) (guard (e (#t 'div0)) (/ a b)))", "safe-div"},
+		{"(list (safe-div 6 3) (safe-div 1 0))", "(2 div0)"},
+		{"(guard (e (#t e)) (+ 1 (call/cc (lambda (k) (guard (e2 (#t 'no)) (k 1))))) (raise 'after))", "after"},
+		{"((lambda (x) (guard (e (#t (set! x e) x)) (raise 5))) 0)", "5"},
+	}
+	vm := NewVM()
+	for _, test := range tests {
+		parser := Parser{}
+		expr, _ := parser.str2expr(test.program)
+		code, err := expr.Compile()
+		if err != nil {
+			t.Errorf("%s: %v", test.program, err)
+			continue
+		}
+		vm.Load(code)
+		ans, err := vm.Run()
+		if err != nil || ans.String() != test.expect {
+			t.Errorf("%s: expect %s, but %v %v", test.program, test.expect, ans, err)
+		}
+	}
+	if _, err := evalString("(raise 'oops)"); err == nil || !strings.Contains(err.Error(), "uncaught exception: oops") {
+		t.Errorf("uncaught: %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	program := `(define (build n acc) (if (= n 0) acc (build (- n 1) (cons n acc))))
+(define (deep n) (if (= n 0) 0 (+ 1 (deep (- n 1)))))`
+	if _, err := evalString(program); err != nil {
+		t.Fatal(err)
+	}
+	run := func(vm *VM, s string) (LObj, error) {
+		parser := Parser{}
+		expr, _ := parser.str2expr(s)
+		code, err := expr.Compile()
+		if err != nil {
+			return LispFalse, err
+		}
+		vm.Load(code)
+		return vm.Run()
+	}
+
+	vm := NewVM()
+	vm.MaxHeap = 10000 * objSize
+	if _, err := run(vm, "(build 100000 '())"); !errors.Is(err, ErrHeapExceeded) {
+		t.Errorf("expect ErrHeapExceeded, but %v", err)
+	}
+	if ans, err := run(vm, "(guard (e (#t (error-object-message e))) (build 100000 '()))"); err != nil || ans.String() != "\"heap limit exceeded\"" {
+		t.Errorf("heap limit is not catchable: %v %v", ans, err)
+	}
+	// retrying in handler runs out of the reserve
+	if _, err := run(vm, "(guard (e (#t (build 100000 '()))) (build 100000 '()))"); !errors.Is(err, ErrHeapExceeded) {
+		t.Errorf("expect ErrHeapExceeded, but %v", err)
+	}
+
+	vm = NewVM()
+	vm.MaxDepth = 1000
+	if ans, err := run(vm, "(deep 500)"); err != nil || ans.String() != "500" {
+		t.Errorf("expect 500, but %v %v", ans, err)
+	}
+	if ans, err := run(vm, "(guard (e ((error-object? e) 'too-deep)) (deep 5000))"); err != nil || ans.String() != "too-deep" {
+		t.Errorf("expect too-deep, but %v %v", ans, err)
+	}
+
+	vm = NewVM()
+	vm.MaxStack = 1000
+	if _, err := run(vm, "(deep 5000)"); !errors.Is(err, ErrStackExceeded) {
+		t.Errorf("expect ErrStackExceeded, but %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	checkEval(t, []struct{ src, expect string }{
+		{`(apply + 1 2 '(3 4))`, "10"},
+		{`(apply list '())`, "()"},
+		{`(apply apply (list + (list 1 2)))`, "3"},
+		{`(apply (lambda (x y z) (list z y x)) 1 '(2 3))`, "(3 2 1)"},
+		{`(+ 1 (call/cc (lambda (k) (apply k '(2)))))`, "3"},
+	})
+	checkEvalErrors(t, []string{`(apply 1 '())`, `(apply + 1 2)`, `(apply +)`})
+	// apply is a tail call
+	interp := NewInterpreter()
+	interp.VM.MaxDepth = 100
+	if ans, err := interp.EvalString(`(define (loop n) (if (= n 0) 'done (apply loop (list (- n 1)))))
+(loop 100000)`); err != nil || ans.String() != "done" {
+		t.Errorf("expect done, but %v %v", ans, err)
+	}
+	// Go primitives calling back Scheme procedures
+	interp = NewInterpreter()
+	if err := interp.Define("twice", func(vm *VM, args ...LObj) (LObj, error) {
+		x, err := vm.Call(args[0], args[1])
+		if err != nil {
+			return LispFalse, err
+		}
+		return vm.TailCall(args[0], x)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ans, err := interp.EvalString(`(twice (lambda (x) (* x 3)) 2)`); err != nil || ans.String() != "18" {
+		t.Errorf("expect 18, but %v %v", ans, err)
+	}
+	twice, _ := interp.EvalString(`twice`)
+	if ans, err := interp.Apply(twice, NewPrimitive("inc", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewNumber(args[0].Value.(int) + 1), nil
+	}), NewNumber(1)); err != nil || ans.String() != "3" {
+		t.Errorf("expect 3, but %v %v", ans, err)
+	}
+	if _, err := interp.EvalString(`(twice (lambda (x) (car x)) 1)`); err == nil {
+		t.Errorf("expect error")
+	}
+}
+
+func TestSRFI1(t *testing.T) {
+	for _, c := range []struct{ src, expect string }{
+		{`(list (fold + 0 '(1 2 3)) (fold cons '() '(1 2 3)) (fold cons* '() '(a b c) '(1 2)))`,
+			"(6 (3 2 1) (b 2 a 1))"},
+		{`(list (fold-right cons '() '(1 2 3)) (fold-right list 'z '(a b) '(1 2 3)))`,
+			"((1 2 3) (a 1 (b 2 z)))"},
+		{`(list (reduce + 0 '(1 2 3)) (reduce + 0 '()) (reduce - 0 '(1 2 10)))`, "(6 0 9)"},
+		{`(list (filter odd? '(1 2 3 4 5)) (remove odd? '(1 2 3 4 5)) (call-with-values (lambda () (partition odd? '(1 2 3))) list))`,
+			"((1 3 5) (2 4) ((1 3) (2)))"},
+		{`(list (call-with-values (lambda () (values 1 2)) +) (call-with-values (lambda () 5) list) (call-with-values values list))`,
+			"(3 (5) ())"},
+		{`(values 1 "a")`, `1 "a"`},
+		{`(list (delete 2 '(1 2 3 2)) (delete 2 '(1 2 3) <) (delete-duplicates '(a b a c b)) (delete-duplicates '(1 2 3 4) (lambda (x y) (= (- y x) 1))))`,
+			"((1 3) (1 2) (a b c) (1 3))"},
+		{`(list (iota 3) (iota 3 1) (iota 3 0 0.5) (iota 0))`, "((0 1 2) (1 2 3) (0 0.5 1) ())"},
+		{`(list (take '(a b c) 2) (drop '(a b c) 2) (take '(1 2 . 3) 2) (last '(1 2 3)))`,
+			"((a b) (c) (1 2) 3)"},
+		{`(list (append-map (lambda (x) (list x x)) '(1 2)) (filter-map (lambda (x) (and-odd x)) '(1 2 3)))`,
+			"((1 1 2 2) (10 30))"},
+		{`(list (find even? '(1 2 3 4)) (find even? '(1 3)) (find-tail even? '(1 2 3)))`, "(2 #f (2 3))"},
+		{`(list (any even? '(1 3)) (any (lambda (x) (and-odd x)) '(2 3)) (any < '(3 1) '(2 2)) (any odd? '()))`,
+			"(#f 30 #t #f)"},
+		{`(list (every odd? '(1 3)) (every (lambda (x) (and-odd x)) '(1 3)) (every odd? '(1 2)) (every odd? '()))`,
+			"(#t 30 #f #t)"},
+		{`(list (count even? '(1 2 4)) (count < '(1 5 2) '(2 3 3)) (list-index even? '(1 3 4)) (list-index even? '(1)))`,
+			"(2 2 2 #f)"},
+		{`(list (lset-adjoin eq? '(a b) 'c 'a 'd) (lset-union eq? '(a b) '(b c) '(d)) (lset-union eq?))`,
+			"((d c a b) (d c a b) ())"},
+		{`(lset-union eq? '(a a c) '(x a x))`, "(x a a c)"},
+		{`(list (lset-intersection (lambda (x y) (= x (car y))) '(1 2) '((1) (3))) (lset-difference (lambda (x y) (= x (car y))) '(1 2) '((1) (3))))`,
+			"((1) (2))"},
+		{`(list (lset<= (lambda (x y) (= x (car y))) '(1) '((1) (2))) (lset-adjoin (lambda (x y) (= (car x) y)) '((1)) 1 2))`,
+			"(#t (2 (1)))"},
+		{`(list (lset-intersection eq? '(a b c) '(b c d) '(c b)) (lset-difference eq? '(a b c) '(b) '(c)))`,
+			"((b c) (a))"},
+		{`(list (lset-xor eq? '(a b) '(b c)) (lset-xor eq? '(a) '(a) '(a)))`, "((a c) (a))"},
+		{`(list (lset<= eq? '(a) '(a b) '(b a c)) (lset<= eq? '(a c) '(a b)) (lset= eq? '(a b) '(b a)) (lset= eq? '(a) '(a b)))`,
+			"(#t #f #t #f)"},
+		{`(list (assoc 2.0 '((1 one) (2 two)) =) (member 2.0 '(1 2 3) =))`, "((2 two) (2 3))"},
+	} {
+		interp := NewInterpreter()
+		if _, err := interp.EvalString(`(define (cons* a b acc) (cons a (cons b acc)))
+(define (odd? n) (if (memv n '(1 3 5)) #t #f))
+(define (even? n) (if (memv n '(0 2 4)) #t #f))
+(define (and-odd n) (if (odd? n) (* n 10) #f))`); err != nil {
+			t.Fatal(err)
+		}
+		ans, err := interp.EvalString(c.src)
+		if err != nil || ans.String() != c.expect {
+			t.Errorf("%s: expect %s, but %v %v", c.src, c.expect, ans, err)
+		}
+	}
+	checkEvalErrors(t, []string{
+		`(fold 1 0 '(1))`,
+		`(filter car '(1))`,
+		`(take '(1 2) 3)`,
+		`(drop '(1) 2)`,
+		`(last '())`,
+		`(append-map (lambda (x) x) '(1))`,
+		`(lset-union 1 '(a))`,
+		`(iota -1)`,
+		`(iota 4611686018427387904)`,      // size overflows
+		`(take '(1) 4611686018427387904)`, // size overflows
+		`(define c (list 1 2))
+(set-cdr! (cdr c) c)
+(drop c 100000000000)`,
+	})
+	// any and every tail call pred on the last elements
+	interp := NewInterpreter()
+	interp.VM.MaxDepth = 100
+	if ans, err := interp.EvalString(`(define (loop n) (if (= n 0) #t (every loop (list (- n 1)))))
+(loop 100000)`); err != nil || ans.String() != "#t" {
+		t.Errorf("expect #t, but %v %v", ans, err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	environment := NewEnvironment()
+	if err := environment.Import("(scheme base)"); err != nil {
+		t.Fatal(err)
+	}
+	interp := NewInterpreterIn(environment)
+	checkEvalError(t, interp, `(fold + 0 '(1 2))`) // before import
+	if ans, err := interp.EvalString(`(import (srfi 1) (scheme char))
+(list (fold + 0 '(1 2)) (char-upcase #\a))`); err != nil || ans.String() != "(3 A)" {
+		t.Errorf("expect (3 A), but %v %v", ans, err)
+	}
+	for _, src := range []string{
+		`(import (no such))`,
+		`(import (srfi 18))`,
+		`(import srfi)`,
+		`(lambda () (import (srfi 1)))`,
+	} {
+		checkEvalError(t, interp, src)
+	}
+	// capabilities already imported can be imported again
+	if _, err := NewInterpreter().EvalString(`(import (scheme base) (srfi 18))`); err != nil {
+		t.Error(err)
+	}
+	// sandboxes import only what they have
+	sandbox, err := NewSandbox("(scheme base)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	interp = NewInterpreterIn(sandbox)
+	if _, err := interp.EvalString(`(import (scheme base))`); err != nil {
+		t.Error(err)
+	}
+	checkEvalError(t, interp, `(import (srfi 1))`)
+	sandbox, _ = NewSandbox("+")
+	interp = NewInterpreterIn(sandbox)
+	checkEvalError(t, interp, `(import (scheme base) (srfi 69) (rgors channel))`)
+	checkEvalError(t, interp, `(vector 1)`)
+}
+
+func TestHashTable(t *testing.T) {
+	checkEval(t, []struct{ src, expect string }{
+		{`(define h (make-hash-table))
+(hash-table-set! h '(1 "a") 'x)
+(hash-table-set! h 2.0 'y)
+(hash-table-set! h (list 1 "a") 'z)
+(list (hash-table-ref h (list 1 (string #\a))) (hash-table-ref/default h 2 'none) (hash-table-size h))`,
+			"(z none 2)"},
+		{`(define h (make-hash-table eq?))
+(define k (list 1))
+(hash-table-set! h k 'a)
+(hash-table-set! h 'sym 'b)
+(list (hash-table-ref/default h k #f) (hash-table-ref/default h (list 1) #f) (hash-table-ref h 'sym))`,
+			"(a #f b)"},
+		{`(define h (make-hash-table eqv?))
+(hash-table-set! h 1.5 'a)
+(hash-table-set! h 0.0 'b)
+(list (hash-table-ref/default h 1.5 #f) (hash-table-ref/default h (* -1 0.0) #f) (hash-table-exists? h 0.0))`,
+			"(a #f #t)"},
+		{`(define h (make-hash-table string=?))
+(hash-table-set! h "key" 1)
+(hash-table-set! h (string #\k #\e #\y) 2)
+(list (hash-table-ref h "key") (hash-table-size h))`, "(2 1)"},
+		{`(define h (alist->hash-table '((a . 1) (b . 2) (a . 3)) eq?))
+(hash-table-delete! h 'b)
+(hash-table-delete! h 'c)
+(list (hash-table->alist h) (hash-table-keys h) (hash-table-values h))`, "(((a . 1)) (a) (1))"},
+		{`(define h (make-hash-table))
+(hash-table-set! h 'n 1)
+(hash-table-update! h 'n (lambda (x) (+ x 10)))
+(hash-table-update! h 'm (lambda (x) (+ x 1)) (lambda () 100))
+(hash-table-update!/default h 'l (lambda (x) (cons 'a x)) '())
+(list (hash-table-ref h 'n) (hash-table-ref h 'm) (hash-table-ref h 'l))`, "(11 101 (a))"},
+		{`(define h (make-hash-table))
+(hash-table-set! h 1 10)
+(hash-table-set! h 2 20)
+(define sum 0)
+(hash-table-walk h (lambda (k v) (set! sum (+ sum k v))))
+sum`, "33"},
+		{`(define h (make-hash-table))
+(list (hash-table-ref h 'x (lambda () 'missing)) (hash-table-ref/default h 'x 0)
+      (hash-table-ref (alist->hash-table '((x . 1))) 'x (lambda () #f) (lambda (v) (+ v 1))))`,
+			"(missing 0 2)"},
+		{`(define h (alist->hash-table '((a . 1))))
+(define c (hash-table-copy h))
+(hash-table-set! c 'b 2)
+(list (hash-table-size h) (hash-table-size c) (hash-table? h) (hash-table? '()))`, "(1 2 #t #f)"},
+		{`(list (= (hash (list 1 "a" #(2))) (hash (list 1 (string #\a) (vector 2))))
+      (< (hash 'x 10) 10) (= (string-hash "ab") (string-hash (string #\a #\b)))
+      (= (hash-by-identity 'a) (hash-by-identity 'a)))`, "(#t #t #t #t)"},
+	})
+	checkEvalErrors(t, []string{
+		`(hash-table-ref (make-hash-table) 'x)`,
+		`(hash-table-set! (make-hash-table string=?) 'x 1)`,
+		`(make-hash-table =)`,
+		`(hash-table-size '())`,
+		`(hash-table-update! (make-hash-table) 'x car)`,
+		`(hash 1 0)`,
+	})
+
+	// cyclic lists which are equal? have the same hash
+	a, b := NewList(NewNumber(1)), NewList(NewNumber(1), NewNumber(1))
+	*a.Cdr = a // the last cdr points back to the list
+	*b.Cdr.Cdr = b
+	if !a.Equal(&b) || a.Hash() != b.Hash() {
+		t.Errorf("cyclic lists: %v %v %d %d", a.Equal(&b), b.Equal(&a), a.Hash(), b.Hash())
+	}
+	// tables are shared with Go
+	table, err := NewHashTable("equal?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Set(NewString("go"), NewNumber(1))
+	interp := NewInterpreter()
+	if err := interp.Define("table", table); err != nil {
+		t.Fatal(err)
+	}
+	if ans, err := interp.EvalString(`(hash-table-set! table "scheme" 2) (hash-table-ref table "go")`); err != nil || ans.String() != "1" {
+		t.Errorf("expect 1, but %v %v", ans, err)
+	}
+	if v, ok := table.Ref(NewString("scheme")); !ok || v.String() != "2" || table.Len() != 2 {
+		t.Errorf("expect 2, but %v %v %d", v, ok, table.Len())
+	}
+	if _, err := NewHashTable("="); err == nil {
+		t.Errorf("expect error for unknown equivalence")
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	run := func(environment *Environment, s string) (LObj, error) {
+		parser := Parser{}
+		expr, _ := parser.str2expr(s)
+		code, err := expr.CompileIn(environment, nil)
+		if err != nil {
+			return LispFalse, err
+		}
+		vm := NewVM()
+		vm.Load(code)
+		return vm.Run()
+	}
+
+	sandbox, err := NewSandbox("+", "car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ans, err := run(sandbox, "(+ 1 (car '(2)))"); err != nil || ans.String() != "3" {
+		t.Errorf("expect 3, but %v %v", ans, err)
+	}
+	if _, err := run(sandbox, "(cons 1 2)"); err == nil || !strings.Contains(err.Error(), "unbound variable: cons") {
+		t.Errorf("cons is visible: %v", err)
+	}
+	// definitions do not leak
+	if _, err := run(sandbox, "(define car 1)"); err != nil {
+		t.Fatal(err)
+	}
+	if ans, err := evalString("(car '(ok))"); err != nil || ans.String() != "ok" {
+		t.Errorf("expect ok, but %v %v", ans, err)
+	}
+	// guard re-raises without the global raise
+	sandbox, _ = NewSandbox("+")
+	if _, err := run(sandbox, "(guard (e (#f 1)) (+ 'a 1))"); err == nil || !strings.Contains(err.Error(), "not number") {
+		t.Errorf("expect not number, but %v", err)
+	}
+	if ans, err := run(sandbox, "(guard (e (#t 2)) (+ 'a 1))"); err != nil || ans.String() != "2" {
+		t.Errorf("expect 2, but %v %v", ans, err)
+	}
+	if _, err := NewSandbox("no-such-primitive"); err == nil {
+		t.Error("unknown primitive is allowed")
+	}
+
+	// capabilities are excluded by default
+	sandbox, _ = NewSandbox()
+	if _, err := run(sandbox, "(eval '(+ 1 2) (environment '(scheme base)))"); err == nil {
+		t.Error("eval is visible in sandbox")
+	}
+	if ans, err := run(sandbox, "(cons 1 2)"); err != nil || ans.String() != "(1 . 2)" {
+		t.Errorf("expect (1 . 2), but %v %v", ans, err)
+	}
+
+	if ans, err := evalString("(eval '(+ 1 2) (environment '(scheme base)))"); err != nil || ans.String() != "3" {
+		t.Errorf("expect 3, but %v %v", ans, err)
+	}
+	if _, err := evalString("(eval '(eval 1 2) (environment '(scheme base)))"); err == nil {
+		t.Error("eval is visible in (scheme base)")
+	}
+	if _, err := evalString("(environment '(scheme eval))"); err == nil {
+		t.Error("capability is given by environment")
+	}
+	// eval runs with the limits of the caller
+	parser := Parser{}
+	expr, _ := parser.str2expr("(eval '((lambda (f) (f f)) (lambda (f) (f f))) (environment '(scheme base)))")
+	code, err := expr.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM()
+	vm.MaxSteps = 10000
+	vm.Load(code)
+	if _, err := vm.Run(); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expect ErrBudgetExceeded, but %v", err)
+	}
+}
+
+func TestInterpreter(t *testing.T) {
+	interp := NewInterpreter()
+	ans, err := interp.EvalString(`
+(define (price item qty) (* (cdr (assq-item item prices)) qty))
+(define (assq-item key alist)
+  (if (null? alist) #f
+      (if (eq? (car (car alist)) key) (car alist) (assq-item key (cdr alist)))))
+(price 'apple 3)`)
+	if err == nil {
+		t.Errorf("prices is unbound, but %v", ans)
+	}
+	if err := interp.Define("prices", map[Symbol]int{"apple": 120, "pear": 200}); err != nil {
+		t.Fatal(err)
+	}
+	ans, err = interp.Call("price", Symbol("pear"), 2)
+	if err != nil || ToGo(ans) != 400 {
+		t.Errorf("expect 400, but %v %v", ans, err)
+	}
+	if err := interp.Define("double", func(args ...LObj) (LObj, error) {
+		return mulNumber(args[0], NewNumber(2))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ans, err = interp.EvalString("(list (double 21) (double 1.5) \"s\" 'sym)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprintf("%#v", ToGo(ans)); got != `[]interface {}{42, 3, "s", "sym"}` {
+		t.Errorf("ToGo: %s", got)
+	}
+	if _, err := interp.Call("no-such-proc"); err == nil {
+		t.Error("unbound procedure is called")
+	}
+	if _, err := FromGo(struct{}{}); err == nil {
+		t.Error("struct is converted")
+	}
+	obj, _ := FromGo([]interface{}{1, []string{"a"}, nil, true})
+	if obj.String() != `(1 ("a") () #t)` {
+		t.Errorf("FromGo: %v", obj)
+	}
+	// interpreters do not share globals
+	if _, err := NewInterpreter().Call("price", Symbol("pear"), 1); err == nil {
+		t.Error("globals are shared")
+	}
+}
+
+func TestWrapGoFunc(t *testing.T) {
+	interp := NewInterpreter()
+	defs := map[string]interface{}{
+		"upcase": strings.ToUpper,
+		"join":   strings.Join,
+		"sum": func(base float64, xs ...int) float64 {
+			for _, x := range xs {
+				base += float64(x)
+			}
+			return base
+		},
+		"checked-div": func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, errors.New("division by zero")
+			}
+			return a / b, nil
+		},
+		"lookup":   func(m map[Symbol]int, key Symbol) int { return m[key] },
+		"describe": func(x interface{}) string { return fmt.Sprintf("%T", x) },
+		"noop":     func() {},
+		"byte":     func(b uint8) uint8 { return b },
+		"div":      func(a, b int) int { return a / b },
+	}
+	for name, fn := range defs {
+		if err := interp.Define(name, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		program string
+		expect  string
+	}{
+		{`(upcase "abc")`, `"ABC"`},
+		{`(join (list "a" "b") ",")`, `"a,b"`},
+		{`(sum 0.5)`, "0.5"},
+		{`(sum 1 2 3)`, "6"},
+		{`(checked-div 7 2)`, "3"},
+		{`(guard (e ((error-object? e) (error-object-message e))) (checked-div 1 0))`, `"division by zero"`},
+		{`(lookup '((a . 1) (b . 2)) 'b)`, "2"},
+		{`(describe 'x)`, `"rgors.Symbol"`},
+		{`(noop)`, "()"},
+		{`(guard (e (#t (error-object-message e))) (div 1 0))`, `"div: runtime error: integer divide by zero"`},
+	}
+	for _, test := range tests {
+		ans, err := interp.EvalString(test.program)
+		if err != nil || ans.String() != test.expect {
+			t.Errorf("%s: expect %s, but %v %v", test.program, test.expect, ans, err)
+		}
+	}
+	for _, program := range []string{
+		`(upcase 1)`,          // not string
+		`(upcase "a" "b")`,    // arity
+		`(checked-div 1.5 1)`, // not integer
+		`(byte 256)`,          // overflow
+		`(lookup '(1 2) 'a)`,  // not alist
+	} {
+		if ans, err := interp.EvalString(program); err == nil {
+			t.Errorf("%s: expect error, but %v", program, ans)
+		}
+	}
+	if _, err := WrapGoFunc(42); err == nil {
+		t.Error("wrapped non-function")
+	}
+	if _, err := WrapGoFunc(func() (int, int) { return 0, 0 }); err == nil {
+		t.Error("wrapped two results")
+	}
+	prim, _ := WrapGoFunc(strings.ToUpper)
+	if prim.String() != "<primitive strings.ToUpper>" {
+		t.Errorf("name: %v", prim)
+	}
+}
+
+type testAccount struct {
+	ID      int
+	Balance int
+}
+
+// register type of sample unless it is, so tests can run with -count=n
+func registerTestType(name string, sample interface{}) (*ForeignType, error) {
+	if ft, ok := lookUpForeignType(reflect.TypeOf(sample)); ok {
+		return ft, nil
+	}
+	return RegisterForeignType(name, sample)
+}
+
+func TestForeign(t *testing.T) {
+	ft, err := registerTestType("account", &testAccount{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft.Print = func(v interface{}) string { return fmt.Sprintf("<account %d>", v.(*testAccount).ID) }
+	ft.Equal = func(a, b interface{}) bool { return a.(*testAccount).ID == b.(*testAccount).ID }
+	if _, err := RegisterForeignType("account2", &testAccount{}); err == nil {
+		t.Error("registered twice")
+	}
+	// predicate does not replace primitive
+	type pairLike struct{}
+	if _, err := RegisterForeignType("pair", pairLike{}); err == nil {
+		t.Error("pair? is replaced")
+	}
+	if _, err := NewForeign(pairLike{}); err == nil {
+		t.Error("type of rejected registration is registered")
+	}
+	if ans, err := NewInterpreter().EvalString("(pair? (cons 1 2))"); err != nil || ans.String() != "#t" {
+		t.Errorf("expect #t, but %v %v", ans, err)
+	}
+
+	interp := NewInterpreter()
+	acc := &testAccount{ID: 7, Balance: 100}
+	if err := interp.Define("acc", acc); err != nil {
+		t.Fatal(err)
+	}
+	interp.Define("deposit", func(a *testAccount, n int) int {
+		a.Balance += n
+		return a.Balance
+	})
+	ans, err := interp.EvalString("(list acc (account? acc) (account? 1) (deposit acc 50))")
+	if err != nil || ans.String() != "(<account 7> #t #f 150)" {
+		t.Errorf("expect (<account 7> #t #f 150), but %v %v", ans, err)
+	}
+	if acc.Balance != 150 {
+		t.Errorf("balance: %d", acc.Balance)
+	}
+	obj, _ := interp.EvalString("acc")
+	if ToGo(obj) != acc {
+		t.Errorf("ToGo: %v", ToGo(obj))
+	}
+	if _, err := interp.EvalString("(deposit 1 2)"); err == nil {
+		t.Error("number is passed as account")
+	}
+
+	same, _ := NewForeign(&testAccount{ID: 7})
+	other, _ := NewForeign(&testAccount{ID: 8})
+	if f := obj.Value.(*Foreign); !f.Equal(same.Value.(*Foreign)) || f.Equal(other.Value.(*Foreign)) {
+		t.Error("equality hook is not used")
+	}
+	if _, err := NewForeign(testAccount{}); err == nil {
+		t.Error("unregistered type is wrapped")
+	}
+}
+
+type raceHandle struct{ n int }
+
+// run with go test -race
+func TestConcurrentVMs(t *testing.T) {
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*3)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// independent interpreters with the same global names
+			interp := NewInterpreter()
+			ans, err := interp.EvalString(fmt.Sprintf(`
+(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))
+(define base %d)
+(eq? (car '(sym-%d-a sym-%d-b)) 'sym-%d-a)`, w, w, w, w))
+			if err != nil || ans.String() != "#t" {
+				errs <- fmt.Errorf("worker %d: expect #t, but %v %v", w, ans, err)
+			}
+			ans, err = interp.EvalString("(+ base (fib 15))")
+			if err != nil || ans.String() != fmt.Sprint(610+w) {
+				errs <- fmt.Errorf("worker %d: expect %d, but %v %v", w, 610+w, ans, err)
+			}
+			// compiling in the shared environment creates cells
+			for i := 0; i < 50; i++ {
+				parser := Parser{}
+				expr, _ := parser.str2expr(fmt.Sprintf("(list 'w%d-%d unbound-%d)", w, i, i))
+				code, err := expr.Compile()
+				if err != nil {
+					errs <- err
+					return
+				}
+				vm := NewVM()
+				vm.Load(code)
+				if _, err := vm.Run(); err == nil {
+					errs <- fmt.Errorf("unbound-%d is bound", i)
+				}
+			}
+		}(w)
+	}
+	// registration while others convert values
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := registerTestType("race-handle", &raceHandle{}); err != nil {
+			errs <- err
+		}
+		FromGo(&raceHandle{})
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if NewSymbol("sym-1-a") != NewSymbol("sym-1-a") {
+		t.Error("symbol is not interned")
+	}
+}
+
+// run with go test -race
+func TestThreads(t *testing.T) {
+	checkEval(t, []struct{ src, expect string }{
+		{`(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))
+(define (spawn n) (thread-start! (make-thread (lambda () (fib n)) n)))
+(define a (spawn 10))
+(define b (spawn 15))
+(define c (spawn 20))
+(list (thread-join! a) (thread-join! b) (thread-join! c))`,
+			"(55 610 6765)"},
+		{`(define m (make-mutex 'counter))
+(define count 0)
+(define (work n)
+  (if (> n 0)
+      ((lambda () (mutex-lock! m) (set! count (+ count 1)) (mutex-unlock! m) (work (- n 1))))
+      n))
+(define a (thread-start! (make-thread (lambda () (work 200)))))
+(define b (thread-start! (make-thread (lambda () (work 200)))))
+(thread-join! a)
+(thread-join! b)
+count`, "400"},
+		// unsynchronized globals lose updates but do not race, see go test -race
+		{`(define count 0)
+(define (work n)
+  (if (> n 0)
+      ((lambda () (set! count (+ count 1)) (work (- n 1))))
+      n))
+(define a (thread-start! (make-thread (lambda () (work 200)))))
+(define b (thread-start! (make-thread (lambda () (work 200)))))
+(work 200)
+(thread-join! a)
+(thread-join! b)
+(<= 200 count 600)`, "#t"},
+		// producer and consumer
+		{`(define m (make-mutex))
+(define cv (make-condition-variable))
+(define box '())
+(define (consume)
+  (mutex-lock! m)
+  (if (null? box)
+      ((lambda () (mutex-unlock! m cv) (consume)))
+      ((lambda (v) (mutex-unlock! m) v) (car box))))
+(define consumer (thread-start! (make-thread consume)))
+(thread-sleep! 0.01)
+(mutex-lock! m)
+(set! box '(hello))
+(condition-variable-signal! cv)
+(mutex-unlock! m)
+(thread-join! consumer)`, "hello"},
+		{`(list (thread? (current-thread)) (thread-name (make-thread car 'worker)) (make-mutex 'm))`,
+			"(#t worker <mutex m>)"},
+		{`(define t (make-thread (lambda () (raise 'oops))))
+(thread-start! t)
+(guard (e ((error-object? e) (cons (error-object-message e) (error-object-irritants e))))
+  (thread-join! t))`,
+			`("thread-join!: uncaught exception" oops)`},
+		{`(define t (thread-start! (make-thread (lambda () (thread-sleep! 10)))))
+(thread-terminate! t)
+(guard (e (#t 'terminated)) (thread-join! t))`, "terminated"},
+		{`(define t (thread-start! (make-thread (lambda () (thread-sleep! 10)))))
+(define v (thread-join! t 0.01 'timeout))
+(thread-terminate! t)
+v`, "timeout"},
+		{`(define m (make-mutex))
+(mutex-lock! m)
+(mutex-lock! m 0.01)`, "#f"},
+		{`(define m (make-mutex))
+(list (mutex-unlock! m) (mutex-lock! m 0.01) (mutex-unlock! m) (mutex-unlock! m))`, "(#t #t #t #t)"},
+	})
+	// continuations can not cross threads
+	_, err := NewInterpreter().EvalString(`
+(define k (call/cc (lambda (k) k)))
+(if (pair? k)
+    k
+    (thread-join! (thread-start! (make-thread (lambda () (k '(1)))))))`)
+	if err == nil || !strings.Contains(err.Error(), "another thread") {
+		t.Errorf("expect continuation error, but %v", err)
+	}
+	// canceling the joining VM stops waiting
+	parser := Parser{}
+	expr, _ := parser.str2expr("(thread-join! (make-thread car))")
+	code, _ := expr.CompileIn(NewInterpreter().Environment, nil)
+	vm := NewVM()
+	vm.Load(code)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := vm.RunContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect deadline exceeded, but %v", err)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	checkEval(t, []struct{ src, expect string }{
+		{`(define ch (make-channel))
+(thread-start! (make-thread (lambda () (channel-send ch 1) (channel-send ch 2) (channel-close ch))))
+(define a (channel-receive ch))
+(define b (channel-receive ch))
+(list a b (eof-object? (channel-receive ch)))`,
+			"(1 2 #t)"},
+		{`(define ch (make-channel 1))
+(channel-send ch 'buffered)
+(define a (channel-receive ch))
+(list (channel? ch) a (channel-receive ch 0.01 'empty))`,
+			"(#t buffered empty)"},
+		{`(define a (make-channel 1))
+(define b (make-channel 1))
+(channel-send b 'hello)
+(channel-select
+  (receive a v (list 'a v))
+  (receive b v (list 'b v)))`, "(b hello)"},
+		{`(define ch (make-channel))
+(channel-select
+  (receive ch v v)
+  (timeout 0.01 'timeout))`, "timeout"},
+		{`(define ch (make-channel 1))
+(define a (channel-select (send ch 'x 'sent) (else 'full)))
+(define b (channel-select (send ch 'y 'sent) (else 'full)))
+(list a b (channel-receive ch))`, "(sent full x)"},
+		{`(define ch (make-channel))
+(channel-close ch)
+(channel-select (receive ch v (eof-object? v)))`, "#t"},
+		// expansion does not see local bindings
+		{`(define ch (make-channel 1))
+(channel-send ch 'v)
+((lambda (car cdr) (channel-select (receive ch v (list car cdr v)))) 1 2)`, "(1 2 v)"},
+		{`(define ch (make-channel))
+(channel-close ch)
+(guard (e (#t (error-object-message e))) (channel-send ch 1))`,
+			`"channel-send: closed channel"`},
+	})
+	// channel shared with Go
+	interp := NewInterpreter()
+	ch := make(chan LObj)
+	interp.Define("requests", ch)
+	go func() {
+		ch <- NewNumber(20)
+		close(ch)
+	}()
+	ans, err := interp.EvalString(`
+(define (sum acc)
+  (channel-select
+    (receive requests v (if (eof-object? v) acc (sum (+ acc v))))))
+(sum 1)`)
+	if err != nil || ans.String() != "21" {
+		t.Errorf("expect 21, but %v %v", ans, err)
+	}
+	// channel-select needs only the library
+	sandbox, err := NewSandbox("(rgors channel)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser := Parser{}
+	expr, _ := parser.str2expr("(channel-select (receive (make-channel) v v) (else 'none))")
+	code, err := expr.CompileIn(sandbox, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM()
+	vm.Load(code)
+	if ans, err := vm.Run(); err != nil || ans.String() != "none" {
+		t.Errorf("expect none, but %v %v", ans, err)
+	}
+	// blocking receive is canceled with Run
+	expr, _ = parser.str2expr("(channel-receive (make-channel))")
+	code, _ = expr.CompileIn(NewInterpreter().Environment, nil)
+	vm = NewVM()
+	vm.Load(code)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := vm.RunContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect deadline exceeded, but %v", err)
+	}
+}
+
+// each src is evaluated by a new interpreter
+func checkEval(t *testing.T, cases []struct{ src, expect string }) {
+	t.Helper()
+	for _, c := range cases {
+		ans, err := NewInterpreter().EvalString(c.src)
+		if err != nil || ans.String() != c.expect {
+			t.Errorf("%s: expect %s, but %v %v", c.src, c.expect, ans, err)
+		}
+	}
+}
+
+// each src must fail in a new interpreter
+func checkEvalErrors(t *testing.T, srcs []string) {
+	t.Helper()
+	for _, src := range srcs {
+		checkEvalError(t, NewInterpreter(), src)
+	}
+}
+
+// src must fail in interp
+func checkEvalError(t *testing.T, interp *Interpreter, src string) {
+	t.Helper()
+	if ans, err := interp.EvalString(src); err == nil {
+		t.Errorf("%s: expect error, but %v", src, ans)
+	}
+}
+
+func TestStrings(t *testing.T) {
+	checkEval(t, []struct{ src, expect string }{
+		{`(string-length "日本語")`, "3"},
+		{`(string-ref "日本語" 1)`, "本"},
+		{`(define s (make-string 3 #\a))
+(string-set! s 1 #\語)
+s`, `"a語a"`},
+		{`(define s "abc")
+(define t (string-copy s))
+(string-set! t 0 #\x)
+(list s t)`, `("abc" "xbc")`},
+		{`(substring "hello world" 6 11)`, `"world"`},
+		{`(string-copy "hello" 1)`, `"ello"`},
+		{`(string-append "foo" "" "bar" "日本")`, `"foobar日本"`},
+		{`(string->list "abc" 1)`, "(b c)"},
+		{`(list->string (list #\a #\b))`, `"ab"`},
+		{`(string #\a #\b)`, `"ab"`},
+		{`(string->symbol "foo")`, "foo"},
+		{`(symbol->string 'bar)`, `"bar"`},
+		{`(list (string->number "42") (string->number "ff" 16) (string->number "1.5") (string->number "x"))`,
+			"(42 255 1.5 #f)"},
+		{`(list (string->number "1.5e3") (string->number "-.5") (string->number "2.") (string->number "1e-1"))`,
+			"(1500 -0.5 2 0.1)"},
+		{`(list (string->number "Infinity") (string->number "nan") (string->number "1_000") (string->number "0x1p2") (string->number ".") (string->number "1e"))`,
+			"(#f #f #f #f #f #f)"},
+		{`(list (number->string 255 16) (number->string -5 2) (number->string 1.5))`, `("ff" "-101" "1.5")`},
+		{`(list (string=? "a" "a" "a") (string<? "a" "b" "c") (string<? "b" "a") (string>=? "b" "b" "a"))`,
+			"(#t #t #f #t)"},
+		{`(list (string-ci=? "Straße" "STRASSE") (string-ci=? "ÄB" "äb") (string-ci<? "a" "B"))`,
+			"(#f #t #t)"},
+		{`(list (string-upcase "hello") (string-downcase "ÄB") (string-foldcase "ABC"))`,
+			`("HELLO" "äb" "abc")`},
+		{`(string? "a")`, "#t"},
+	})
+	checkEvalErrors(t, []string{
+		`(string-ref "abc" 3)`,
+		`(string-set! "abc" -1 #\a)`,
+		`(substring "abc" 2 1)`,
+		`(string-append "a" 'b)`,
+		`(number->string 1.5 2)`,
+		`(make-string 4611686018427387904)`, // size overflows
+	})
+	// charged before it is made
+	parser := Parser{}
+	expr, _ := parser.str2expr("(make-string 100000000)")
+	code, _ := expr.Compile()
+	vm := NewVM()
+	vm.MaxHeap = 1 << 20
+	vm.Load(code)
+	if _, err := vm.Run(); !errors.Is(err, ErrHeapExceeded) {
+		t.Errorf("expect ErrHeapExceeded, but %v", err)
+	}
+}
+
+func TestChars(t *testing.T) {
+	checkEval(t, []struct{ src, expect string }{
+		{`(list (char? #\a) (char? "a"))`, "(#t #f)"},
+		{`(list (char->integer #\A) (integer->char 955))`, "(65 λ)"},
+		{`(list (char-upcase #\ä) (char-downcase #\Λ) (char-foldcase #\Σ))`, "(Ä λ σ)"},
+		{`(list (char-alphabetic? #\語) (char-alphabetic? #\1) (char-numeric? #\٣) (char-whitespace? #\　))`,
+			"(#t #f #t #t)"},
+		{`(list (char-upper-case? #\A) (char-lower-case? #\A))`, "(#t #f)"},
+		{`(list (digit-value #\7) (digit-value #\٣) (digit-value #\𝟙) (digit-value #\a))`,
+			"(7 3 1 #f)"},
+		{`(list (char=? #\a #\a #\a) (char<? #\a #\b #\c) (char>? #\a #\b) (char>=? #\b #\b #\a))`,
+			"(#t #t #f #t)"},
+		{`(list (char-ci=? #\a #\A) (char-ci<? #\a #\B) (char=? #\a #\A))`, "(#t #t #f)"},
+	})
+	checkEvalErrors(t, []string{`(integer->char #xD800)`, `(integer->char -1)`, `(char-upcase "a")`, `(char<? #\a 1)`})
+}
+
+func TestVectors(t *testing.T) {
+	checkEval(t, []struct{ src, expect string }{
+		{`#(1 "a" #(b) ())`, `#(1 "a" #(b) ())`},
+		{`(vector)`, "#()"},
+		{`(make-vector 3 'x)`, "#(x x x)"},
+		{`(define v (vector 1 2 3))
+(vector-set! v 0 'a)
+(list (vector-ref v 0) (vector-length v) (vector? v) (vector? '(1)))`, "(a 3 #t #f)"},
+		{`(list (vector->list #(1 2 3)) (vector->list #(1 2 3) 1) (vector->list #(1 2 3) 1 2))`,
+			"((1 2 3) (2 3) (2))"},
+		{`(list->vector '(1 2))`, "#(1 2)"},
+		{`(define v (vector 1 2 3 4))
+(vector-fill! v 0 1 3)
+v`, "#(1 0 0 4)"},
+		{`(define v (vector 1 2 3 4 5))
+(vector-copy! v 1 v 0 3)
+v`, "#(1 1 2 3 5)"},
+		{`(define a #(1 2 3))
+(define b (vector-copy a 1))
+(vector-set! b 0 'x)
+(list a b)`, "(#(1 2 3) #(x 3))"},
+		{`(vector-map + #(1 2 3) #(10 20))`, "#(11 22)"},
+		{`(vector-map (lambda (x) (* x x)) #(1 2 3))`, "#(1 4 9)"},
+		{`(define sum 0)
+(vector-for-each (lambda (x) (set! sum (+ sum x))) #(1 2 3))
+sum`, "6"},
+		// errors in callbacks are caught by guards outside and inside
+		{`(guard (e (#t (list 'outer e)))
+  (vector-map (lambda (x) (if (= x 2) (raise 'two) x)) #(1 2 3)))`, "(outer two)"},
+		{`(vector-map (lambda (x) (guard (e (#t 'caught)) (if (= x 2) (raise 'two) x))) #(1 2 3))`,
+			"#(1 caught 3)"},
+		// continuations escape from callbacks, past guards inside
+		{`(call/cc (lambda (k) (vector-for-each k #(1))))`, "1"},
+		{`(+ 1 (call/cc (lambda (k) (vector-map (lambda (x) (guard (e (#t 'caught)) (if (= x 2) (k x) x))) #(1 2 3)))))`,
+			"3"},
+	})
+	checkEvalErrors(t, []string{
+		`(vector-ref #(1 2) 2)`,
+		`(vector-set! #(1 2) -1 0)`,
+		`(vector-ref '(1 2) 0)`,
+		`(vector-copy! (vector 1 2) 1 #(1 2))`,
+		`(vector->list #(1 2) 2 1)`,
+		`(vector-map car #(1))`,
+		`(make-vector 4611686018427387904)`, // size overflows
+		// continuations can not return into callbacks which returned
+		`(define k #f)
+(vector-map (lambda (x) (call/cc (lambda (c) (set! k c) x))) #(1))
+(k 2)`,
+	})
+}
+
+func TestLists(t *testing.T) {
+	checkEval(t, []struct{ src, expect string }{
+		{`(define p (list 1 2))
+(set-car! p 'a)
+(set-cdr! (cdr p) '(3))
+p`, "(a 2 3)"},
+		{`(list (cadr '(1 2 3)) (cddr '(1 2 3)) (caar '((1) 2)) (cdar '((1 . 4) 2)))`, "(2 (3) 1 4)"},
+		{`(define c (list 1 2))
+(set-cdr! (cdr c) c)
+(list (list? '(1 2)) (list? '(1 . 2)) (list? c) (list? '()))`, "(#t #f #f #t)"},
+		{`(list (make-list 2 'x) (length '(1 2 3)) (length '()))`, "((x x) 3 0)"},
+		{`(list (append) (append '(1)) (append '(1) '(2 3) '() '(4 . 5)) (append '() 'a))`,
+			"(() (1) (1 2 3 4 . 5) a)"},
+		{`(define a (list 1 2))
+(define b (append a '(3)))
+(set-car! a 'x)
+(list a b (reverse '(1 2 3)))`, "((x 2) (1 2 3) (3 2 1))"},
+		{`(define a (list 1 2))
+(define b (list-copy a))
+(set-car! b 'x)
+(list a b (list-tail '(1 2 3) 1) (list-ref '(1 2 3) 2))`, "((1 2) (x 2) (2 3) 3)"},
+		{`(list (memq 'c '(a b c d)) (memq 'e '(a b)) (memv 1.5 '(1 1.5 2)) (member "b" '("a" "b")))`,
+			`((c d) #f (1.5 2) ("b"))`},
+		{`(member 2.0 '(1 2 3) =)`, "(2 3)"},
+		{`(list (assq 'b '((a 1) (b 2))) (assv 2 '((1 one) (2 two))) (assoc "b" '(("a" . 1) ("b" . 2))))`,
+			`((b 2) (2 two) ("b" . 2))`},
+		{`(assoc 2.0 '((1 one) (2 two)) =)`, "(2 two)"},
+		{`(list (map + '(1 2 3) '(10 20)) (map (lambda (x) (* x x)) '(1 2 3)) (map car '()))`,
+			"((11 22) (1 4 9) ())"},
+		{`(define acc '())
+(for-each (lambda (x y) (set! acc (cons (list x y) acc))) '(1 2) '(a b c))
+acc`, "((2 b) (1 a))"},
+		// nested callbacks
+		{`(map (lambda (row) (map (lambda (x) (* x 10)) row)) '((1 2) (3)))`, "((10 20) (30))"},
+		// escape from callbacks of callbacks
+		{`(call/cc (lambda (k) (for-each (lambda (x) (if (> x 1) (k x) x)) '(1 2 3)) 'none))`, "2"},
+		{`(call/cc (lambda (k) (map (lambda (x) (map (lambda (y) (k (list x y))) '(a))) '(1))))`, "(1 a)"},
+		// procedures called by primitives can use the Scheme stack deeply
+		{`(define (count n) (if (= n 0) 0 (+ 1 (count (- n 1)))))
+(map count '(1000 2000))`, "(1000 2000)"},
+		// cycles are written with labels
+		{`(define c (list 1 2))
+(set-cdr! (cdr c) c)
+c`, "#0=(1 2 . #0#)"},
+		{`(define c (list 1 2))
+(set-car! (cdr c) c)
+(define v (vector 'v c))
+(vector-set! v 0 v)
+(list v c)`, "(#0=#(#0# #1=(1 #1#)) #1#)"},
+		{`(define x (list 1))
+(list x x)`, "((1) (1))"},
+		{`(define c (list 1))
+(set-cdr! c c)
+(guard (e (#t (error-object-message e))) (length c))`, `"length: not list: (1 1 1 1 1 1 1 1 ...)"`},
+	})
+	checkEvalErrors(t, []string{
+		`(set-car! '() 1)`,
+		`(length '(1 . 2))`,
+		`(reverse '(1 . 2))`,
+		`(list-tail '(1) 2)`,
+		`(list-ref '(1) 1)`,
+		`(assq 'a '(1 2))`,
+		`(map 1 '(1))`,
+		`(cadr '(1))`,
+		`(make-list 4611686018427387904)`, // size overflows
+		`(define c (list 1 2))
+(set-cdr! (cdr c) c)
+(list-tail c 100000000000)`,
+		`(define c (list 1 2))
+(set-cdr! (cdr c) c)
+(list-ref c 100000000000)`,
+		`(list-ref '(1 2 . 3) 3)`,
+		`(define c (list 1 2))
+(set-cdr! (cdr c) c)
+(memq 3 c)`,
+	})
+	// limits apply to procedures called by primitives
+	interp := NewInterpreter()
+	interp.VM.MaxSteps = 10000
+	_, err := interp.EvalString(`(define (loop) (loop)) (map (lambda (x) (loop)) '(1))`)
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expect budget exceeded, but %v", err)
+	}
+	// results of map are charged while it runs
+	interp = NewInterpreter()
+	interp.VM.MaxHeap = 10000 * objSize
+	_, err = interp.EvalString(`(define c (list 1)) (set-cdr! c c) (map - c)`)
+	if !errors.Is(err, ErrHeapExceeded) {
+		t.Errorf("expect heap exceeded, but %v", err)
+	}
+}
+
+func TestDebuggerInCall(t *testing.T) {
+	// primitives called by primitives break in the code made by vm.Call
+	program := `(vector-map car (vector '(3)))`
+	out, err := debugString(program, []string{"car"}, []string{"eval (+ 1 100)", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "101") {
+		t.Errorf("eval in a procedure called by a primitive:\n%s", out)
+	}
 }
@@ -0,0 +1,570 @@
+package rgors
+
+import (
+	"fmt"
+)
+
+// SRFI 1 list library
+// procedures taking several lists stop at the end of the shortest one.
+
+// arguments of proc from proper lists, as long as the shortest list
+func listArgs(name string, lists []LObj) ([][]LObj, error) {
+	elems := make([][]LObj, len(lists))
+	n := -1
+	for i, list := range lists {
+		e, err := listElems(name, list)
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = e
+		if n < 0 || len(e) < n {
+			n = len(e)
+		}
+	}
+	rows := make([][]LObj, n)
+	for k := range rows {
+		rows[k] = make([]LObj, len(lists))
+		for i := range lists {
+			rows[k][i] = elems[i][k]
+		}
+	}
+	return rows, nil
+}
+
+// elements of list which satisfy pred and which do not, of (name pred list)
+func partitionList(vm *VM, name string, args []LObj) (in, out []LObj, err error) {
+	if !args[0].IsProcedure() {
+		return nil, nil, fmt.Errorf("%s: not procedure: %v", name, args[0])
+	}
+	elems, err := listElems(name, args[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	in, out = make([]LObj, 0), make([]LObj, 0)
+	for _, elem := range elems {
+		v, err := vm.Call(args[0], elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		if v.ToBool() {
+			in = append(in, elem)
+		} else {
+			out = append(out, elem)
+		}
+	}
+	return in, out, nil
+}
+
+// whether x is in elems by eq, called as (eq elem x)
+func containsElem(elems []LObj, x LObj, eq func(x, y LObj) (bool, error)) (bool, error) {
+	for _, elem := range elems {
+		found, err := eq(elem, x)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// eq with its arguments swapped
+func flipped(eq func(x, y LObj) (bool, error)) func(x, y LObj) (bool, error) {
+	return func(x, y LObj) (bool, error) { return eq(y, x) }
+}
+
+// elements of xs which are in ys if in, or not in ys if not, called as (eq x y)
+func selectElems(xs, ys []LObj, in bool, eq func(x, y LObj) (bool, error)) ([]LObj, error) {
+	ret := make([]LObj, 0)
+	for _, x := range xs {
+		found, err := containsElem(ys, x, flipped(eq))
+		if err != nil {
+			return nil, err
+		}
+		if found == in {
+			ret = append(ret, x)
+		}
+	}
+	return ret, nil
+}
+
+// equivalence and elements of lists of lset operation (lset-op = list ...)
+func lsetArgs(vm *VM, name string, args []LObj) (func(x, y LObj) (bool, error), [][]LObj, error) {
+	if !args[0].IsProcedure() {
+		return nil, nil, fmt.Errorf("%s: not procedure: %v", name, args[0])
+	}
+	sets := make([][]LObj, len(args)-1)
+	for i, arg := range args[1:] {
+		elems, err := listElems(name, arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		sets[i] = elems
+	}
+	return equivalence(vm, &args[0]), sets, nil
+}
+
+// elements of ys not in xs are added to xs
+func adjoinElems(xs, ys []LObj, eq func(x, y LObj) (bool, error)) ([]LObj, error) {
+	for _, y := range ys {
+		found, err := containsElem(xs, y, eq)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			xs = append(xs, y)
+		}
+	}
+	return xs, nil
+}
+
+// whether every list is a subset of the next one, or also a superset if equal,
+// eq is called with the element of the former list first
+func lsetCompare(vm *VM, name string, args []LObj, equal bool) (LObj, error) {
+	eq, sets, err := lsetArgs(vm, name, args)
+	if err != nil {
+		return LispFalse, err
+	}
+	for i := 0; i+1 < len(sets); i++ {
+		rest, err := selectElems(sets[i], sets[i+1], false, eq)
+		if err != nil || len(rest) > 0 {
+			return LispFalse, err
+		}
+		if equal {
+			if rest, err = selectElems(sets[i+1], sets[i], false, flipped(eq)); err != nil || len(rest) > 0 {
+				return LispFalse, err
+			}
+		}
+	}
+	return LispTrue, nil
+}
+
+func init() {
+	// (fold kons knil list1 list2 ...), kons is called as (kons elem ... acc)
+	DefineVMPrimitive("fold", 3, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		if !args[0].IsProcedure() {
+			return LispFalse, fmt.Errorf("fold: not procedure: %v", args[0])
+		}
+		acc := args[1]
+		lists := append([]LObj(nil), args[2:]...)
+		for {
+			cars, ok := nextCars(lists)
+			if !ok {
+				return acc, nil
+			}
+			var err error
+			if acc, err = vm.Call(args[0], append(cars, acc)...); err != nil {
+				return LispFalse, err
+			}
+		}
+	})
+	// (fold-right kons knil list1 list2 ...), from the last elements
+	DefineVMPrimitive("fold-right", 3, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		if !args[0].IsProcedure() {
+			return LispFalse, fmt.Errorf("fold-right: not procedure: %v", args[0])
+		}
+		rows, err := listArgs("fold-right", args[2:])
+		if err != nil {
+			return LispFalse, err
+		}
+		acc := args[1]
+		for k := len(rows) - 1; k >= 0; k-- {
+			if acc, err = vm.Call(args[0], append(rows[k], acc)...); err != nil {
+				return LispFalse, err
+			}
+		}
+		return acc, nil
+	})
+	// (reduce f ridentity list), ridentity only if list is empty
+	DefineVMPrimitive("reduce", 3, 3, func(vm *VM, args ...LObj) (LObj, error) {
+		if !args[0].IsProcedure() {
+			return LispFalse, fmt.Errorf("reduce: not procedure: %v", args[0])
+		}
+		elems, err := listElems("reduce", args[2])
+		if err != nil || len(elems) == 0 {
+			return args[1], err
+		}
+		acc := elems[0]
+		for _, elem := range elems[1:] {
+			if acc, err = vm.Call(args[0], elem, acc); err != nil {
+				return LispFalse, err
+			}
+		}
+		return acc, nil
+	})
+	DefineVMPrimitive("filter", 2, 2, func(vm *VM, args ...LObj) (LObj, error) {
+		in, _, err := partitionList(vm, "filter", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		return chargedList(vm, in)
+	})
+	DefineVMPrimitive("remove", 2, 2, func(vm *VM, args ...LObj) (LObj, error) {
+		_, out, err := partitionList(vm, "remove", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		return chargedList(vm, out)
+	})
+	DefineVMPrimitive("partition", 2, 2, func(vm *VM, args ...LObj) (LObj, error) {
+		in, out, err := partitionList(vm, "partition", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		if err := vm.charge((len(in)+len(out))*2*objSize + 2*objSize); err != nil {
+			return LispFalse, err
+		}
+		return LObj{Type: DTValues, Value: []LObj{NewList(in...), NewList(out...)}}, nil
+	})
+	// (delete x list [=])
+	DefineVMPrimitive("delete", 2, 3, func(vm *VM, args ...LObj) (LObj, error) {
+		var compare *LObj
+		if len(args) > 2 {
+			compare = &args[2]
+		}
+		eq := equivalence(vm, compare)
+		elems, err := listElems("delete", args[1])
+		if err != nil {
+			return LispFalse, err
+		}
+		ret := make([]LObj, 0)
+		for _, elem := range elems {
+			found, err := eq(args[0], elem)
+			if err != nil {
+				return LispFalse, err
+			}
+			if !found {
+				ret = append(ret, elem)
+			}
+		}
+		return chargedList(vm, ret)
+	})
+	// (delete-duplicates list [=]), the first one of duplicates is kept
+	DefineVMPrimitive("delete-duplicates", 1, 2, func(vm *VM, args ...LObj) (LObj, error) {
+		var compare *LObj
+		if len(args) > 1 {
+			compare = &args[1]
+		}
+		elems, err := listElems("delete-duplicates", args[0])
+		if err != nil {
+			return LispFalse, err
+		}
+		ret, err := adjoinElems(nil, elems, equivalence(vm, compare))
+		if err != nil {
+			return LispFalse, err
+		}
+		return chargedList(vm, ret)
+	})
+	// (iota count [start [step]])
+	DefineAllocator("iota", 1, 3, func(args []LObj) int {
+		return sizeCost(args[0], 2*objSize)
+	}, func(args ...LObj) (LObj, error) {
+		k, err := sizeArg("iota", args, 0, 2*objSize)
+		if err != nil {
+			return LispFalse, err
+		}
+		start, step := NewNumber(0), NewNumber(1)
+		if len(args) > 1 {
+			start = args[1]
+		}
+		if len(args) > 2 {
+			step = args[2]
+		}
+		if !start.IsNumber() || !step.IsNumber() {
+			return LispFalse, fmt.Errorf("iota: not number: %v %v", start, step)
+		}
+		ret := LispNull
+		for i := k - 1; i >= 0; i-- {
+			n, err := mulNumber(NewNumber(i), step)
+			if err != nil {
+				return LispFalse, err
+			}
+			if n, err = addNumber(start, n); err != nil {
+				return LispFalse, err
+			}
+			ret = Cons(n, ret)
+		}
+		return ret, nil
+	})
+	// (take list k), the first k elements
+	DefineAllocator("take", 2, 2, func(args []LObj) int {
+		return sizeCost(args[1], 2*objSize)
+	}, func(args ...LObj) (LObj, error) {
+		k, err := sizeArg("take", args, 1, 2*objSize)
+		if err != nil {
+			return LispFalse, err
+		}
+		elems := make([]LObj, 0)
+		for obj := args[0]; len(elems) < k; obj = *obj.Cdr {
+			if !obj.IsPair() {
+				return LispFalse, fmt.Errorf("take: index out of range: %d", k)
+			}
+			elems = append(elems, *obj.Car)
+		}
+		return NewList(elems...), nil
+	})
+	// (drop list k), shares the tail with list
+	DefinePrimitive("drop", 2, 2, func(args ...LObj) (LObj, error) {
+		k, err := indexArg("drop", args, 1, int(^uint(0)>>1))
+		if err != nil {
+			return LispFalse, err
+		}
+		if args[0].listEnd() == nil { // the walk is bounded by its pairs
+			return LispFalse, fmt.Errorf("drop: circular list")
+		}
+		obj := args[0]
+		for ; k > 0; k-- {
+			if !obj.IsPair() {
+				return LispFalse, fmt.Errorf("drop: index out of range: %v", args[1])
+			}
+			obj = *obj.Cdr
+		}
+		return obj, nil
+	})
+	DefinePrimitive("last", 1, 1, func(args ...LObj) (LObj, error) {
+		if !args[0].IsPair() {
+			return LispFalse, fmt.Errorf("last: not pair: %v", args[0])
+		}
+		if args[0].listEnd() == nil {
+			return LispFalse, fmt.Errorf("last: circular list")
+		}
+		elem := &args[0]
+		for elem.Cdr.IsPair() {
+			elem = elem.Cdr
+		}
+		return *elem.Car, nil
+	})
+	// (append-map f list1 list2 ...), results of f are appended
+	DefineVMPrimitive("append-map", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		results, err := mapLists(vm, "append-map", args, true)
+		if err != nil {
+			return LispFalse, err
+		}
+		ret := make([]LObj, 0)
+		for elem := &results; elem.IsPair(); elem = elem.Cdr {
+			elems, err := listElems("append-map", *elem.Car)
+			if err != nil {
+				return LispFalse, err
+			}
+			ret = append(ret, elems...)
+		}
+		return chargedList(vm, ret)
+	})
+	// (filter-map f list1 list2 ...), true results of f
+	DefineVMPrimitive("filter-map", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		results, err := mapLists(vm, "filter-map", args, true)
+		if err != nil {
+			return LispFalse, err
+		}
+		ret := make([]LObj, 0)
+		for elem := &results; elem.IsPair(); elem = elem.Cdr {
+			if elem.Car.ToBool() {
+				ret = append(ret, *elem.Car)
+			}
+		}
+		return chargedList(vm, ret)
+	})
+
+	// searching
+	// (find pred list), the first element satisfying pred, #f if none
+	// (find-tail pred list), the first pair whose car satisfies pred
+	for _, name := range []string{"find", "find-tail"} {
+		name := name
+		DefineVMPrimitive(name, 2, 2, func(vm *VM, args ...LObj) (LObj, error) {
+			if !args[0].IsProcedure() {
+				return LispFalse, fmt.Errorf("%s: not procedure: %v", name, args[0])
+			}
+			for obj := args[1]; obj.IsPair(); obj = *obj.Cdr {
+				v, err := vm.Call(args[0], *obj.Car)
+				if err != nil {
+					return LispFalse, err
+				}
+				if !v.ToBool() {
+					continue
+				}
+				if name == "find" {
+					return *obj.Car, nil
+				}
+				return obj, nil
+			}
+			return LispFalse, nil
+		})
+	}
+	// (any pred list1 list2 ...), the first true value of pred.
+	// (every pred list1 list2 ...), the last value of pred if all are true.
+	// pred is tail called on the last elements.
+	for _, name := range []string{"any", "every"} {
+		name := name
+		DefineVMPrimitive(name, 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+			if !args[0].IsProcedure() {
+				return LispFalse, fmt.Errorf("%s: not procedure: %v", name, args[0])
+			}
+			lists := append([]LObj(nil), args[1:]...)
+			ret := NewBoolean(name == "every")
+			for {
+				cars, ok := nextCars(lists)
+				if !ok {
+					return ret, nil
+				}
+				for _, list := range lists {
+					if !list.IsPair() {
+						return vm.TailCall(args[0], cars...)
+					}
+				}
+				v, err := vm.Call(args[0], cars...)
+				if err != nil {
+					return LispFalse, err
+				}
+				if v.ToBool() == (name == "any") {
+					return v, nil
+				}
+				ret = v
+			}
+		})
+	}
+	// (count pred list1 list2 ...)
+	DefineVMPrimitive("count", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		if !args[0].IsProcedure() {
+			return LispFalse, fmt.Errorf("count: not procedure: %v", args[0])
+		}
+		lists := append([]LObj(nil), args[1:]...)
+		n := 0
+		for {
+			cars, ok := nextCars(lists)
+			if !ok {
+				return NewNumber(n), nil
+			}
+			v, err := vm.Call(args[0], cars...)
+			if err != nil {
+				return LispFalse, err
+			}
+			if v.ToBool() {
+				n++
+			}
+		}
+	})
+	// (list-index pred list1 list2 ...), #f if none
+	DefineVMPrimitive("list-index", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		if !args[0].IsProcedure() {
+			return LispFalse, fmt.Errorf("list-index: not procedure: %v", args[0])
+		}
+		lists := append([]LObj(nil), args[1:]...)
+		for i := 0; ; i++ {
+			cars, ok := nextCars(lists)
+			if !ok {
+				return LispFalse, nil
+			}
+			v, err := vm.Call(args[0], cars...)
+			if err != nil {
+				return LispFalse, err
+			}
+			if v.ToBool() {
+				return NewNumber(i), nil
+			}
+		}
+	})
+
+	// lists as sets, compared by the first argument
+	// (lset-adjoin = list elt ...)
+	DefineVMPrimitive("lset-adjoin", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		eq, sets, err := lsetArgs(vm, "lset-adjoin", args[:2])
+		if err != nil {
+			return LispFalse, err
+		}
+		ret := args[1]
+		added, err := adjoinElems(sets[0], args[2:], eq)
+		if err != nil {
+			return LispFalse, err
+		}
+		if err := vm.charge((len(added) - len(sets[0])) * 2 * objSize); err != nil {
+			return LispFalse, err
+		}
+		for _, elem := range added[len(sets[0]):] {
+			ret = Cons(elem, ret)
+		}
+		return ret, nil
+	})
+	DefineVMPrimitive("lset-union", 1, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		eq, sets, err := lsetArgs(vm, "lset-union", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		if len(sets) == 0 {
+			return LispNull, nil
+		}
+		// list1 is kept, new elements are consed onto it as lset-adjoin
+		ret := args[1]
+		added := sets[0]
+		for _, set := range sets[1:] {
+			if added, err = adjoinElems(added, set, eq); err != nil {
+				return LispFalse, err
+			}
+		}
+		if err := vm.charge((len(added) - len(sets[0])) * 2 * objSize); err != nil {
+			return LispFalse, err
+		}
+		for _, elem := range added[len(sets[0]):] {
+			ret = Cons(elem, ret)
+		}
+		return ret, nil
+	})
+	DefineVMPrimitive("lset-intersection", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		eq, sets, err := lsetArgs(vm, "lset-intersection", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		ret := sets[0]
+		for _, set := range sets[1:] {
+			if ret, err = selectElems(ret, set, true, eq); err != nil {
+				return LispFalse, err
+			}
+		}
+		return chargedList(vm, ret)
+	})
+	DefineVMPrimitive("lset-difference", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		eq, sets, err := lsetArgs(vm, "lset-difference", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		ret := sets[0]
+		for _, set := range sets[1:] {
+			if ret, err = selectElems(ret, set, false, eq); err != nil {
+				return LispFalse, err
+			}
+		}
+		return chargedList(vm, ret)
+	})
+	// elements in odd number of lists
+	DefineVMPrimitive("lset-xor", 1, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		eq, sets, err := lsetArgs(vm, "lset-xor", args)
+		if err != nil {
+			return LispFalse, err
+		}
+		ret := make([]LObj, 0)
+		for _, set := range sets {
+			xs, err := selectElems(ret, set, false, eq)
+			if err != nil {
+				return LispFalse, err
+			}
+			ys, err := selectElems(set, ret, false, flipped(eq))
+			if err != nil {
+				return LispFalse, err
+			}
+			ret = append(xs, ys...)
+		}
+		return chargedList(vm, ret)
+	})
+	DefineVMPrimitive("lset<=", 1, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		return lsetCompare(vm, "lset<=", args, false)
+	})
+	DefineVMPrimitive("lset=", 1, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		return lsetCompare(vm, "lset=", args, true)
+	})
+
+	DefineLibrary("(srfi 1)",
+		"cons", "car", "cdr", "list", "set-car!", "set-cdr!", "caar", "cadr", "cdar", "cddr",
+		"list?", "make-list", "length", "append", "reverse", "list-copy", "list-tail", "list-ref",
+		"memq", "memv", "member", "assq", "assv", "assoc", "map", "for-each",
+		"fold", "fold-right", "reduce", "filter", "remove", "partition", "delete", "delete-duplicates",
+		"iota", "take", "drop", "last", "append-map", "filter-map",
+		"find", "find-tail", "any", "every", "count", "list-index",
+		"lset-adjoin", "lset-union", "lset-intersection", "lset-difference", "lset-xor", "lset<=", "lset=")
+}
@@ -0,0 +1,416 @@
+package rgors
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// strings
+// Value of DTString is *[]rune, so characters can be indexed and set in O(1).
+
+const runeSize = 4
+
+func NewString(s string) LObj {
+	return newString([]rune(s))
+}
+
+func newString(runes []rune) LObj {
+	return LObj{Type: DTString, Value: &runes}
+}
+
+// characters of DTString
+func (obj *LObj) runes() []rune {
+	return *obj.Value.(*[]rune)
+}
+
+// Go string of DTString
+func (obj *LObj) goString() string {
+	return string(obj.runes())
+}
+
+// exact integer argument in [0, max]
+func indexArg(name string, args []LObj, i, max int) (int, error) {
+	k, ok := args[i].Value.(int)
+	if !args[i].IsNumber() || !ok {
+		return 0, fmt.Errorf("%s: not exact integer: %v", name, args[i])
+	}
+	if k < 0 || k > max {
+		return 0, fmt.Errorf("%s: index out of range: %d", name, k)
+	}
+	return k, nil
+}
+
+// length argument i of k objects of unit bytes, k*unit is at most maxAlloc
+func sizeArg(name string, args []LObj, i, unit int) (int, error) {
+	k, err := indexArg(name, args, i, int(^uint(0)>>1))
+	if err != nil {
+		return 0, err
+	}
+	if k > maxAlloc/unit {
+		return 0, fmt.Errorf("%s: too large: %d", name, k)
+	}
+	return k, nil
+}
+
+// cost of sizeArg, 0 if it is rejected by sizeArg
+func sizeCost(arg LObj, unit int) int {
+	k, _ := arg.Value.(int)
+	if k < 0 || k > maxAlloc/unit {
+		return 0
+	}
+	return k * unit
+}
+
+// optional [start [end]] arguments from i, for sequence of length n
+func rangeArgs(name string, args []LObj, i, n int) (start, end int, err error) {
+	end = n
+	if i < len(args) {
+		if start, err = indexArg(name, args, i, n); err != nil {
+			return 0, 0, err
+		}
+	}
+	if i+1 < len(args) {
+		if end, err = indexArg(name, args, i+1, n); err != nil {
+			return 0, 0, err
+		}
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("%s: bad range: %d %d", name, start, end)
+	}
+	return start, end, nil
+}
+
+func checkStrings(name string, args []LObj) error {
+	for _, arg := range args {
+		if arg.Type != DTString {
+			return fmt.Errorf("%s: not string: %v", name, arg)
+		}
+	}
+	return nil
+}
+
+// simple case folding of a character
+func foldRune(r rune) rune {
+	return unicode.ToLower(unicode.ToUpper(r))
+}
+
+func compareRunes(a, b []rune, fold bool) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x, y := a[i], b[i]
+		if fold {
+			x, y = foldRune(x), foldRune(y)
+		}
+		if x != y {
+			return compareInt(int(x), int(y))
+		}
+	}
+	return compareInt(len(a), len(b))
+}
+
+// compare adjacent strings
+func compareStrings(name string, fold bool, pred func(int) bool) func(args ...LObj) (LObj, error) {
+	return func(args ...LObj) (LObj, error) {
+		if err := checkStrings(name, args); err != nil {
+			return LispFalse, err
+		}
+		for k := 0; k+1 < len(args); k++ {
+			if !pred(compareRunes(args[k].runes(), args[k+1].runes(), fold)) {
+				return LispFalse, nil
+			}
+		}
+		return LispTrue, nil
+	}
+}
+
+// convert whole string by f
+func mapString(name string, f func(string) string) func(args ...LObj) (LObj, error) {
+	return func(args ...LObj) (LObj, error) {
+		if err := checkStrings(name, args); err != nil {
+			return LispFalse, err
+		}
+		return NewString(f(args[0].goString())), nil
+	}
+}
+
+// cost of new string as long as the first argument
+func stringCost(args []LObj) int {
+	if args[0].Type != DTString {
+		return 0
+	}
+	return len(args[0].runes()) * runeSize
+}
+
+// number in radix, #f if not a number
+func parseNumber(s string, radix int) LObj {
+	if i, err := strconv.ParseInt(s, radix, 0); err == nil {
+		return NewNumber(int(i))
+	}
+	if radix == 10 && isDecimal(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return NewNumber(f)
+		}
+	}
+	return LispFalse
+}
+
+// whether s is [sign] digits [. digits] [e [sign] digits] with some digits in
+// the mantissa, ParseFloat also takes inf, nan, hex and underscores
+func isDecimal(s string) bool {
+	digits := func(i int) int {
+		for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+			i++
+		}
+		return i
+	}
+	i := 0
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	start := i
+	i = digits(i)
+	n := i - start
+	if i < len(s) && s[i] == '.' {
+		end := digits(i + 1)
+		n += end - i - 1
+		i = end
+	}
+	if n == 0 {
+		return false
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		end := digits(i)
+		if end == i {
+			return false
+		}
+		i = end
+	}
+	return i == len(s)
+}
+
+func radixArg(name string, args []LObj, i int) (int, error) {
+	if i >= len(args) {
+		return 10, nil
+	}
+	switch radix, _ := args[i].Value.(int); radix {
+	case 2, 8, 10, 16:
+		if args[i].IsNumber() {
+			return radix, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: bad radix: %v", name, args[i])
+}
+
+func init() {
+	DefinePrimitive("string?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Type == DTString), nil
+	})
+	// (make-string k [char])
+	DefineAllocator("make-string", 1, 2, func(args []LObj) int {
+		return sizeCost(args[0], runeSize)
+	}, func(args ...LObj) (LObj, error) {
+		k, err := sizeArg("make-string", args, 0, runeSize)
+		if err != nil {
+			return LispFalse, err
+		}
+		fill := ' '
+		if len(args) > 1 {
+			if args[1].Type != DTChar {
+				return LispFalse, fmt.Errorf("make-string: not char: %v", args[1])
+			}
+			fill = args[1].Value.(rune)
+		}
+		runes := make([]rune, k)
+		for i := range runes {
+			runes[i] = fill
+		}
+		return newString(runes), nil
+	})
+	DefineAllocator("string", 0, -1, func(args []LObj) int {
+		return len(args) * runeSize
+	}, func(args ...LObj) (LObj, error) {
+		runes := make([]rune, len(args))
+		for i, arg := range args {
+			if arg.Type != DTChar {
+				return LispFalse, fmt.Errorf("string: not char: %v", arg)
+			}
+			runes[i] = arg.Value.(rune)
+		}
+		return newString(runes), nil
+	})
+	DefinePrimitive("string-length", 1, 1, func(args ...LObj) (LObj, error) {
+		if err := checkStrings("string-length", args); err != nil {
+			return LispFalse, err
+		}
+		return NewNumber(len(args[0].runes())), nil
+	})
+	DefinePrimitive("string-ref", 2, 2, func(args ...LObj) (LObj, error) {
+		if err := checkStrings("string-ref", args[:1]); err != nil {
+			return LispFalse, err
+		}
+		runes := args[0].runes()
+		k, err := indexArg("string-ref", args, 1, len(runes)-1)
+		if err != nil {
+			return LispFalse, err
+		}
+		return NewChar(runes[k]), nil
+	})
+	DefinePrimitive("string-set!", 3, 3, func(args ...LObj) (LObj, error) {
+		if err := checkStrings("string-set!", args[:1]); err != nil {
+			return LispFalse, err
+		}
+		runes := args[0].runes()
+		k, err := indexArg("string-set!", args, 1, len(runes)-1)
+		if err != nil {
+			return LispFalse, err
+		}
+		if args[2].Type != DTChar {
+			return LispFalse, fmt.Errorf("string-set!: not char: %v", args[2])
+		}
+		runes[k] = args[2].Value.(rune)
+		return LispNull, nil
+	})
+	// (substring s start end), (string-copy s [start [end]])
+	for _, name := range []string{"substring", "string-copy"} {
+		name := name
+		min := 1
+		if name == "substring" {
+			min = 3
+		}
+		DefineAllocator(name, min, 3, stringCost, func(args ...LObj) (LObj, error) {
+			if err := checkStrings(name, args[:1]); err != nil {
+				return LispFalse, err
+			}
+			runes := args[0].runes()
+			start, end, err := rangeArgs(name, args, 1, len(runes))
+			if err != nil {
+				return LispFalse, err
+			}
+			return newString(append([]rune(nil), runes[start:end]...)), nil
+		})
+	}
+	DefineAllocator("string-append", 0, -1, func(args []LObj) int {
+		n := 0
+		for _, arg := range args {
+			if arg.Type == DTString {
+				n += len(arg.runes())
+			}
+		}
+		return n * runeSize
+	}, func(args ...LObj) (LObj, error) {
+		if err := checkStrings("string-append", args); err != nil {
+			return LispFalse, err
+		}
+		runes := make([]rune, 0)
+		for _, arg := range args {
+			runes = append(runes, arg.runes()...)
+		}
+		return newString(runes), nil
+	})
+	// (string->list s [start [end]])
+	DefineAllocator("string->list", 1, 3, func(args []LObj) int {
+		return stringCost(args) / runeSize * 2 * objSize
+	}, func(args ...LObj) (LObj, error) {
+		if err := checkStrings("string->list", args[:1]); err != nil {
+			return LispFalse, err
+		}
+		runes := args[0].runes()
+		start, end, err := rangeArgs("string->list", args, 1, len(runes))
+		if err != nil {
+			return LispFalse, err
+		}
+		chars := make([]LObj, 0, end-start)
+		for _, r := range runes[start:end] {
+			chars = append(chars, NewChar(r))
+		}
+		return NewList(chars...), nil
+	})
+	DefinePrimitive("list->string", 1, 1, func(args ...LObj) (LObj, error) {
+		if !args[0].IsList() {
+			return LispFalse, fmt.Errorf("list->string: not list: %s", args[0].shortString())
+		}
+		runes := make([]rune, 0)
+		for elem := &args[0]; elem.IsPair(); elem = elem.Cdr {
+			if elem.Car.Type != DTChar {
+				return LispFalse, fmt.Errorf("list->string: not char: %v", *elem.Car)
+			}
+			runes = append(runes, elem.Car.Value.(rune))
+		}
+		return newString(runes), nil
+	})
+	DefinePrimitive("string->symbol", 1, 1, func(args ...LObj) (LObj, error) {
+		if err := checkStrings("string->symbol", args); err != nil {
+			return LispFalse, err
+		}
+		return *NewSymbol(args[0].goString()), nil
+	})
+	DefinePrimitive("symbol->string", 1, 1, func(args ...LObj) (LObj, error) {
+		if !args[0].IsSymbol() {
+			return LispFalse, fmt.Errorf("symbol->string: not symbol: %v", args[0])
+		}
+		return NewString(args[0].Value.(string)), nil
+	})
+	// (string->number s [radix]), #f if s is not a number
+	DefinePrimitive("string->number", 1, 2, func(args ...LObj) (LObj, error) {
+		if err := checkStrings("string->number", args[:1]); err != nil {
+			return LispFalse, err
+		}
+		radix, err := radixArg("string->number", args, 1)
+		if err != nil {
+			return LispFalse, err
+		}
+		return parseNumber(args[0].goString(), radix), nil
+	})
+	// (number->string z [radix]), inexact numbers only in radix 10
+	DefinePrimitive("number->string", 1, 2, func(args ...LObj) (LObj, error) {
+		if !args[0].IsNumber() {
+			return LispFalse, fmt.Errorf("number->string: not number: %v", args[0])
+		}
+		radix, err := radixArg("number->string", args, 1)
+		if err != nil {
+			return LispFalse, err
+		}
+		i, ok := args[0].Value.(int)
+		if !ok {
+			if radix != 10 {
+				return LispFalse, fmt.Errorf("number->string: inexact number in radix %d: %v", radix, args[0])
+			}
+			return NewString(args[0].String()), nil
+		}
+		return NewString(strconv.FormatInt(int64(i), radix)), nil
+	})
+
+	// comparisons
+	for _, fold := range []bool{false, true} {
+		prefix := "string"
+		if fold {
+			prefix = "string-ci"
+		}
+		DefinePrimitive(prefix+"=?", 1, -1, compareStrings(prefix+"=?", fold, func(c int) bool { return c == 0 }))
+		DefinePrimitive(prefix+"<?", 1, -1, compareStrings(prefix+"<?", fold, func(c int) bool { return c < 0 }))
+		DefinePrimitive(prefix+">?", 1, -1, compareStrings(prefix+">?", fold, func(c int) bool { return c > 0 }))
+		DefinePrimitive(prefix+"<=?", 1, -1, compareStrings(prefix+"<=?", fold, func(c int) bool { return c <= 0 }))
+		DefinePrimitive(prefix+">=?", 1, -1, compareStrings(prefix+">=?", fold, func(c int) bool { return c >= 0 }))
+	}
+
+	// case conversion
+	DefineAllocator("string-upcase", 1, 1, stringCost, mapString("string-upcase", strings.ToUpper))
+	DefineAllocator("string-downcase", 1, 1, stringCost, mapString("string-downcase", strings.ToLower))
+	DefineAllocator("string-foldcase", 1, 1, stringCost, mapString("string-foldcase", func(s string) string {
+		return strings.Map(foldRune, s)
+	}))
+
+	DefineLibrary("(scheme base)",
+		"string?", "make-string", "string", "string-length", "string-ref", "string-set!",
+		"substring", "string-append", "string-copy", "string->list", "list->string",
+		"string->symbol", "symbol->string", "string->number", "number->string",
+		"string=?", "string<?", "string>?", "string<=?", "string>=?")
+	DefineLibrary("(scheme char)",
+		"string-ci=?", "string-ci<?", "string-ci>?", "string-ci<=?", "string-ci>=?",
+		"string-upcase", "string-downcase", "string-foldcase")
+}
@@ -0,0 +1,379 @@
+package rgors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// SRFI-18 threads
+// each thread runs its thunk on its own VM in a goroutine.
+// the VM has limits of the starting VM, and stops when its Run is canceled.
+// globals are shared, continuations can not cross threads.
+// timeouts are relative seconds, #f means no timeout.
+
+// Thread is Value of DTThread
+type Thread struct {
+	Name  LObj
+	thunk LObj
+
+	mu     sync.Mutex // guards state and cancel
+	state  int
+	cancel context.CancelFunc
+	done   chan struct{} // closed when terminated
+	result LObj
+	err    error
+}
+
+// thread states
+const (
+	threadNew = iota
+	threadRunning
+	threadTerminated
+)
+
+var errTerminated = errors.New("terminated thread")
+
+func NewThread(thunk, name LObj) LObj {
+	return LObj{Type: DTThread, Value: &Thread{Name: name, thunk: thunk, done: make(chan struct{})}}
+}
+
+// run thunk on a new VM with limits of vm
+func (th *Thread) start(vm *VM) error {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if th.state != threadNew {
+		return fmt.Errorf("thread-start!: already started: %v", th)
+	}
+	ctx, cancel := context.WithCancel(vm.Context())
+	th.state = threadRunning
+	th.cancel = cancel
+	child := vm.spawn()
+	child.thread = th
+	go func() {
+		defer cancel()
+		ret, err := child.ApplyContext(ctx, th.thunk)
+		th.mu.Lock()
+		if th.state == threadRunning {
+			th.result, th.err = ret, err
+			th.state = threadTerminated
+			close(th.done)
+		}
+		th.mu.Unlock()
+	}()
+	return nil
+}
+
+func (th *Thread) terminate() {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if th.state == threadTerminated {
+		return
+	}
+	if th.cancel != nil {
+		th.cancel()
+	}
+	th.err = errTerminated
+	th.state = threadTerminated
+	close(th.done)
+}
+
+func (th *Thread) String() string {
+	return namedString("thread", th.Name)
+}
+
+// new VM with limits of vm
+func (vm *VM) spawn() *VM {
+	child := NewVM()
+	child.MaxSteps = vm.MaxSteps
+	child.MaxStack = vm.MaxStack
+	child.MaxDepth = vm.MaxDepth
+	child.MaxHeap = vm.MaxHeap
+	return child
+}
+
+// Mutex is Value of DTMutex
+// locked when ch holds a value
+type Mutex struct {
+	Name LObj
+	ch   chan struct{}
+}
+
+func NewMutex(name LObj) LObj {
+	return LObj{Type: DTMutex, Value: &Mutex{Name: name, ch: make(chan struct{}, 1)}}
+}
+
+func (m *Mutex) String() string {
+	return namedString("mutex", m.Name)
+}
+
+// ConditionVariable is Value of DTConditionVariable
+type ConditionVariable struct {
+	Name    LObj
+	mu      sync.Mutex
+	waiters []chan struct{}
+}
+
+func NewConditionVariable(name LObj) LObj {
+	return LObj{Type: DTConditionVariable, Value: &ConditionVariable{Name: name}}
+}
+
+func (cv *ConditionVariable) String() string {
+	return namedString("condition-variable", cv.Name)
+}
+
+// channel closed by signal
+func (cv *ConditionVariable) wait() chan struct{} {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	ch := make(chan struct{})
+	cv.waiters = append(cv.waiters, ch)
+	return ch
+}
+
+// remove waiter which timed out
+func (cv *ConditionVariable) cancel(ch chan struct{}) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	for i, waiter := range cv.waiters {
+		if waiter == ch {
+			cv.waiters = append(cv.waiters[:i], cv.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (cv *ConditionVariable) signal(all bool) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	for len(cv.waiters) > 0 {
+		close(cv.waiters[0])
+		cv.waiters = cv.waiters[1:]
+		if !all {
+			return
+		}
+	}
+}
+
+// <kind name>, or <kind> if name is #f
+func namedString(kind string, name LObj) string {
+	if name.Eq(&LispFalse) {
+		return fmt.Sprintf("<%s>", kind)
+	}
+	return fmt.Sprintf("<%s %v>", kind, name)
+}
+
+// optional name argument, #f if missing
+func optionalName(args []LObj, i int) LObj {
+	if i < len(args) {
+		return args[i]
+	}
+	return LispFalse
+}
+
+// optional timeout argument in seconds.
+// timer channel is nil if there is no timeout, stop must be called.
+func timeoutArg(name string, args []LObj, i int) (timer <-chan time.Time, stop func(), err error) {
+	if i >= len(args) || args[i].Eq(&LispFalse) {
+		return nil, func() {}, nil
+	}
+	if !args[i].IsNumber() {
+		return nil, nil, fmt.Errorf("%s: bad timeout: %v", name, args[i])
+	}
+	t := time.NewTimer(time.Duration(toFloat(args[i]) * float64(time.Second)))
+	return t.C, func() { t.Stop() }, nil
+}
+
+func init() {
+	DefineVMPrimitive("current-thread", 0, 0, func(vm *VM, args ...LObj) (LObj, error) {
+		if vm.thread == nil { // primordial thread
+			vm.thread = &Thread{Name: LispFalse, state: threadRunning, done: make(chan struct{})}
+		}
+		return LObj{Type: DTThread, Value: vm.thread}, nil
+	})
+	DefinePrimitive("thread?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Type == DTThread), nil
+	})
+	DefinePrimitive("make-thread", 1, 2, func(args ...LObj) (LObj, error) {
+		if !args[0].IsProcedure() {
+			return LispFalse, fmt.Errorf("make-thread: not procedure: %v", args[0])
+		}
+		return NewThread(args[0], optionalName(args, 1)), nil
+	})
+	DefinePrimitive("thread-name", 1, 1, func(args ...LObj) (LObj, error) {
+		if args[0].Type != DTThread {
+			return LispFalse, fmt.Errorf("thread-name: not thread: %v", args[0])
+		}
+		return args[0].Value.(*Thread).Name, nil
+	})
+	DefineVMPrimitive("thread-start!", 1, 1, func(vm *VM, args ...LObj) (LObj, error) {
+		if args[0].Type != DTThread {
+			return LispFalse, fmt.Errorf("thread-start!: not thread: %v", args[0])
+		}
+		return args[0], args[0].Value.(*Thread).start(vm)
+	})
+	DefinePrimitive("thread-yield!", 0, 0, func(args ...LObj) (LObj, error) {
+		runtime.Gosched()
+		return LispNull, nil
+	})
+	DefineVMPrimitive("thread-sleep!", 1, 1, func(vm *VM, args ...LObj) (LObj, error) {
+		timer, stop, err := timeoutArg("thread-sleep!", args, 0)
+		if err != nil {
+			return LispFalse, err
+		}
+		defer stop()
+		select {
+		case <-timer:
+			return LispNull, nil
+		case <-vm.Context().Done():
+			return LispFalse, vm.Context().Err()
+		}
+	})
+	DefinePrimitive("thread-terminate!", 1, 1, func(args ...LObj) (LObj, error) {
+		if args[0].Type != DTThread {
+			return LispFalse, fmt.Errorf("thread-terminate!: not thread: %v", args[0])
+		}
+		args[0].Value.(*Thread).terminate()
+		return LispNull, nil
+	})
+	// (thread-join! thread [timeout [timeout-val]])
+	DefineVMPrimitive("thread-join!", 1, 3, func(vm *VM, args ...LObj) (LObj, error) {
+		if args[0].Type != DTThread {
+			return LispFalse, fmt.Errorf("thread-join!: not thread: %v", args[0])
+		}
+		th := args[0].Value.(*Thread)
+		timer, stop, err := timeoutArg("thread-join!", args, 1)
+		if err != nil {
+			return LispFalse, err
+		}
+		defer stop()
+		select {
+		case <-th.done:
+		case <-timer:
+			if len(args) > 2 {
+				return args[2], nil
+			}
+			return LispFalse, fmt.Errorf("thread-join!: timeout: %v", th)
+		case <-vm.Context().Done():
+			return LispFalse, vm.Context().Err()
+		}
+		th.mu.Lock()
+		defer th.mu.Unlock()
+		switch {
+		case th.err == errTerminated:
+			return LispFalse, fmt.Errorf("thread-join!: %v: %v", errTerminated, th)
+		case th.err != nil:
+			// raise error object with the reason as irritant
+			reason := NewErrorObject("thread-join!: uncaught exception", NewList(conditionObject(th.err)), th.err)
+			return LispFalse, &Condition{Obj: reason}
+		}
+		return th.result, nil
+	})
+
+	// mutexes
+	DefinePrimitive("make-mutex", 0, 1, func(args ...LObj) (LObj, error) {
+		return NewMutex(optionalName(args, 0)), nil
+	})
+	DefinePrimitive("mutex?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Type == DTMutex), nil
+	})
+	DefinePrimitive("mutex-name", 1, 1, func(args ...LObj) (LObj, error) {
+		if args[0].Type != DTMutex {
+			return LispFalse, fmt.Errorf("mutex-name: not mutex: %v", args[0])
+		}
+		return args[0].Value.(*Mutex).Name, nil
+	})
+	// (mutex-lock! mutex [timeout]), #f on timeout
+	DefineVMPrimitive("mutex-lock!", 1, 2, func(vm *VM, args ...LObj) (LObj, error) {
+		if args[0].Type != DTMutex {
+			return LispFalse, fmt.Errorf("mutex-lock!: not mutex: %v", args[0])
+		}
+		timer, stop, err := timeoutArg("mutex-lock!", args, 1)
+		if err != nil {
+			return LispFalse, err
+		}
+		defer stop()
+		select {
+		case args[0].Value.(*Mutex).ch <- struct{}{}:
+			return LispTrue, nil
+		case <-timer:
+			return LispFalse, nil
+		case <-vm.Context().Done():
+			return LispFalse, vm.Context().Err()
+		}
+	})
+	// (mutex-unlock! mutex [condition-variable [timeout]])
+	// with condition variable, wait for its signal after unlocking.
+	// the mutex is not locked again, #f on timeout.
+	// unlocking a mutex which is not locked does nothing
+	DefineVMPrimitive("mutex-unlock!", 1, 3, func(vm *VM, args ...LObj) (LObj, error) {
+		if args[0].Type != DTMutex {
+			return LispFalse, fmt.Errorf("mutex-unlock!: not mutex: %v", args[0])
+		}
+		var cv *ConditionVariable
+		var signaled chan struct{}
+		if len(args) > 1 {
+			if args[1].Type != DTConditionVariable {
+				return LispFalse, fmt.Errorf("mutex-unlock!: not condition variable: %v", args[1])
+			}
+			// wait before unlocking not to miss signal
+			cv = args[1].Value.(*ConditionVariable)
+			signaled = cv.wait()
+		}
+		select {
+		case <-args[0].Value.(*Mutex).ch:
+		default: // not locked, nothing to unlock
+		}
+		if cv == nil {
+			return LispTrue, nil
+		}
+		timer, stop, err := timeoutArg("mutex-unlock!", args, 2)
+		if err != nil {
+			cv.cancel(signaled)
+			return LispFalse, err
+		}
+		defer stop()
+		select {
+		case <-signaled:
+			return LispTrue, nil
+		case <-timer:
+			cv.cancel(signaled)
+			return LispFalse, nil
+		case <-vm.Context().Done():
+			cv.cancel(signaled)
+			return LispFalse, vm.Context().Err()
+		}
+	})
+
+	// condition variables
+	DefinePrimitive("make-condition-variable", 0, 1, func(args ...LObj) (LObj, error) {
+		return NewConditionVariable(optionalName(args, 0)), nil
+	})
+	DefinePrimitive("condition-variable?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Type == DTConditionVariable), nil
+	})
+	DefinePrimitive("condition-variable-signal!", 1, 1, func(args ...LObj) (LObj, error) {
+		if args[0].Type != DTConditionVariable {
+			return LispFalse, fmt.Errorf("condition-variable-signal!: not condition variable: %v", args[0])
+		}
+		args[0].Value.(*ConditionVariable).signal(false)
+		return LispNull, nil
+	})
+	DefinePrimitive("condition-variable-broadcast!", 1, 1, func(args ...LObj) (LObj, error) {
+		if args[0].Type != DTConditionVariable {
+			return LispFalse, fmt.Errorf("condition-variable-broadcast!: not condition variable: %v", args[0])
+		}
+		args[0].Value.(*ConditionVariable).signal(true)
+		return LispNull, nil
+	})
+
+	DefineLibrary("(srfi 18)",
+		"current-thread", "thread?", "make-thread", "thread-name", "thread-start!",
+		"thread-yield!", "thread-sleep!", "thread-terminate!", "thread-join!",
+		"make-mutex", "mutex?", "mutex-name", "mutex-lock!", "mutex-unlock!",
+		"make-condition-variable", "condition-variable?",
+		"condition-variable-signal!", "condition-variable-broadcast!")
+}
@@ -0,0 +1,65 @@
+package rgors
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Tracer observes VM execution.
+// set VM.Tracer to enable, nil to disable.
+type Tracer interface {
+	OnInstruction(op int, vm *VM)          // before each instruction
+	OnCall(proc LObj, args []LObj, vm *VM) // procedure application
+	OnReturn(value LObj, vm *VM)           // return to the caller's frame
+}
+
+// DumpTracer prints all registers on every instruction
+type DumpTracer struct {
+	Out io.Writer
+}
+
+func (t *DumpTracer) OnInstruction(op int, vm *VM) {
+	fmt.Fprintln(t.Out, vm)
+}
+
+func (t *DumpTracer) OnCall(proc LObj, args []LObj, vm *VM) {}
+
+func (t *DumpTracer) OnReturn(value LObj, vm *VM) {}
+
+// CallTracer prints procedure calls and return values,
+// indented by the depth of call frames
+type CallTracer struct {
+	Out io.Writer
+}
+
+func (t *CallTracer) OnInstruction(op int, vm *VM) {}
+
+func (t *CallTracer) OnCall(proc LObj, args []LObj, vm *VM) {
+	fmt.Fprintf(t.Out, "%s%v\n", t.indent(vm), Cons(proc, NewList(args...)))
+}
+
+func (t *CallTracer) OnReturn(value LObj, vm *VM) {
+	fmt.Fprintf(t.Out, "%s=> %v\n", t.indent(vm), value)
+}
+
+func (t *CallTracer) indent(vm *VM) string {
+	return strings.Repeat("  ", vm.Depth())
+}
+
+// register accessors for tracers
+
+// the accumulator
+func (vm *VM) Accumulator() LObj {
+	return vm.a
+}
+
+// the current code and the next instruction
+func (vm *VM) Code() (*Code, int) {
+	return vm.code, vm.pc
+}
+
+// number of saved call frames
+func (vm *VM) Depth() int {
+	return len(vm.frames)
+}
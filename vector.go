@@ -0,0 +1,217 @@
+package rgors
+
+import (
+	"fmt"
+)
+
+// vectors
+// Value of DTVector is []LObj, elements are set in place.
+
+func checkVectors(name string, args []LObj) error {
+	for _, arg := range args {
+		if arg.Type != DTVector {
+			return fmt.Errorf("%s: not vector: %v", name, arg)
+		}
+	}
+	return nil
+}
+
+// cost of new vector as long as the first argument
+func vectorCost(args []LObj) int {
+	if args[0].Type != DTVector {
+		return 0
+	}
+	return len(args[0].Value.([]LObj)) * objSize
+}
+
+// elements of vectors at index i, as arguments of procedure
+func vectorArgs(vectors []LObj, i int) []LObj {
+	args := make([]LObj, len(vectors))
+	for k, v := range vectors {
+		args[k] = v.Value.([]LObj)[i]
+	}
+	return args
+}
+
+// length of the shortest vector
+func minVectorLength(vectors []LObj) int {
+	n := len(vectors[0].Value.([]LObj))
+	for _, v := range vectors[1:] {
+		if m := len(v.Value.([]LObj)); m < n {
+			n = m
+		}
+	}
+	return n
+}
+
+func init() {
+	DefinePrimitive("vector?", 1, 1, func(args ...LObj) (LObj, error) {
+		return NewBoolean(args[0].Type == DTVector), nil
+	})
+	// (make-vector k [fill])
+	DefineAllocator("make-vector", 1, 2, func(args []LObj) int {
+		return sizeCost(args[0], objSize)
+	}, func(args ...LObj) (LObj, error) {
+		k, err := sizeArg("make-vector", args, 0, objSize)
+		if err != nil {
+			return LispFalse, err
+		}
+		fill := LispFalse
+		if len(args) > 1 {
+			fill = args[1]
+		}
+		elems := make([]LObj, k)
+		for i := range elems {
+			elems[i] = fill
+		}
+		return NewVector(elems...), nil
+	})
+	DefineAllocator("vector", 0, -1, func(args []LObj) int {
+		return len(args) * objSize
+	}, func(args ...LObj) (LObj, error) {
+		return NewVector(append([]LObj(nil), args...)...), nil
+	})
+	DefinePrimitive("vector-length", 1, 1, func(args ...LObj) (LObj, error) {
+		if err := checkVectors("vector-length", args); err != nil {
+			return LispFalse, err
+		}
+		return NewNumber(len(args[0].Value.([]LObj))), nil
+	})
+	DefinePrimitive("vector-ref", 2, 2, func(args ...LObj) (LObj, error) {
+		if err := checkVectors("vector-ref", args[:1]); err != nil {
+			return LispFalse, err
+		}
+		elems := args[0].Value.([]LObj)
+		k, err := indexArg("vector-ref", args, 1, len(elems)-1)
+		if err != nil {
+			return LispFalse, err
+		}
+		return elems[k], nil
+	})
+	DefinePrimitive("vector-set!", 3, 3, func(args ...LObj) (LObj, error) {
+		if err := checkVectors("vector-set!", args[:1]); err != nil {
+			return LispFalse, err
+		}
+		elems := args[0].Value.([]LObj)
+		k, err := indexArg("vector-set!", args, 1, len(elems)-1)
+		if err != nil {
+			return LispFalse, err
+		}
+		elems[k] = args[2]
+		return LispNull, nil
+	})
+	// (vector->list v [start [end]])
+	DefineAllocator("vector->list", 1, 3, func(args []LObj) int {
+		return vectorCost(args) * 2
+	}, func(args ...LObj) (LObj, error) {
+		if err := checkVectors("vector->list", args[:1]); err != nil {
+			return LispFalse, err
+		}
+		elems := args[0].Value.([]LObj)
+		start, end, err := rangeArgs("vector->list", args, 1, len(elems))
+		if err != nil {
+			return LispFalse, err
+		}
+		return NewList(elems[start:end]...), nil
+	})
+	DefinePrimitive("list->vector", 1, 1, func(args ...LObj) (LObj, error) {
+		if !args[0].IsList() {
+			return LispFalse, fmt.Errorf("list->vector: not list: %s", args[0].shortString())
+		}
+		elems := make([]LObj, 0)
+		for elem := &args[0]; elem.IsPair(); elem = elem.Cdr {
+			elems = append(elems, *elem.Car)
+		}
+		return NewVector(elems...), nil
+	})
+	// (vector-copy v [start [end]])
+	DefineAllocator("vector-copy", 1, 3, vectorCost, func(args ...LObj) (LObj, error) {
+		if err := checkVectors("vector-copy", args[:1]); err != nil {
+			return LispFalse, err
+		}
+		elems := args[0].Value.([]LObj)
+		start, end, err := rangeArgs("vector-copy", args, 1, len(elems))
+		if err != nil {
+			return LispFalse, err
+		}
+		return NewVector(append([]LObj(nil), elems[start:end]...)...), nil
+	})
+	// (vector-fill! v fill [start [end]])
+	DefinePrimitive("vector-fill!", 2, 4, func(args ...LObj) (LObj, error) {
+		if err := checkVectors("vector-fill!", args[:1]); err != nil {
+			return LispFalse, err
+		}
+		elems := args[0].Value.([]LObj)
+		start, end, err := rangeArgs("vector-fill!", args, 2, len(elems))
+		if err != nil {
+			return LispFalse, err
+		}
+		for i := start; i < end; i++ {
+			elems[i] = args[1]
+		}
+		return LispNull, nil
+	})
+	// (vector-copy! to at from [start [end]])
+	DefinePrimitive("vector-copy!", 3, 5, func(args ...LObj) (LObj, error) {
+		if err := checkVectors("vector-copy!", []LObj{args[0], args[2]}); err != nil {
+			return LispFalse, err
+		}
+		to, from := args[0].Value.([]LObj), args[2].Value.([]LObj)
+		at, err := indexArg("vector-copy!", args, 1, len(to))
+		if err != nil {
+			return LispFalse, err
+		}
+		start, end, err := rangeArgs("vector-copy!", args, 3, len(from))
+		if err != nil {
+			return LispFalse, err
+		}
+		if at+end-start > len(to) {
+			return LispFalse, fmt.Errorf("vector-copy!: index out of range: %d", at+end-start)
+		}
+		copy(to[at:], from[start:end]) // overlapping is fine
+		return LispNull, nil
+	})
+	// (vector-map proc v1 v2 ...), as long as the shortest vector
+	DefineVMPrimitive("vector-map", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		if !args[0].IsProcedure() {
+			return LispFalse, fmt.Errorf("vector-map: not procedure: %v", args[0])
+		}
+		if err := checkVectors("vector-map", args[1:]); err != nil {
+			return LispFalse, err
+		}
+		n := minVectorLength(args[1:])
+		if err := vm.charge(n * objSize); err != nil {
+			return LispFalse, err
+		}
+		elems := make([]LObj, n)
+		for i := range elems {
+			elem, err := vm.Call(args[0], vectorArgs(args[1:], i)...)
+			if err != nil {
+				return LispFalse, err
+			}
+			elems[i] = elem
+		}
+		return NewVector(elems...), nil
+	})
+	// (vector-for-each proc v1 v2 ...)
+	DefineVMPrimitive("vector-for-each", 2, -1, func(vm *VM, args ...LObj) (LObj, error) {
+		if !args[0].IsProcedure() {
+			return LispFalse, fmt.Errorf("vector-for-each: not procedure: %v", args[0])
+		}
+		if err := checkVectors("vector-for-each", args[1:]); err != nil {
+			return LispFalse, err
+		}
+		n := minVectorLength(args[1:])
+		for i := 0; i < n; i++ {
+			if _, err := vm.Call(args[0], vectorArgs(args[1:], i)...); err != nil {
+				return LispFalse, err
+			}
+		}
+		return LispNull, nil
+	})
+
+	DefineLibrary("(scheme base)",
+		"vector?", "make-vector", "vector", "vector-length", "vector-ref", "vector-set!",
+		"vector->list", "list->vector", "vector-copy", "vector-fill!", "vector-copy!",
+		"vector-map", "vector-for-each")
+}
@@ -1,245 +1,630 @@
 package rgors
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"unsafe"
 )
 
 type VM struct {
-	a LObj // the accumulator
-	x LObj // the next expression (list)
-	e LObj // the current environment
-	r LObj // the current value rib
-	s LObj // the current stack
+	a        LObj      // the accumulator
+	code     *Code     // the current code
+	pc       int       // the next instruction in code
+	f        int       // the current frame, arguments are below
+	c        *Closure  // the current closure
+	stack    []LObj    // the current stack, s is its length
+	frames   []Frame   // the saved call frames
+	handlers []handler // installed by guard, innermost last
+
+	Tracer   Tracer // nil if not tracing
+	MaxSteps int    // instructions allowed in one Run, 0 means no limit
+	steps    int    // instructions executed in the current Run
+
+	// resource limits, 0 means no limit
+	MaxStack  int // length of the stack
+	MaxDepth  int // number of call frames
+	MaxHeap   int // approximate bytes allocated in one Run
+	alloc     int // bytes allocated in the current Run
+	heapLimit int // MaxHeap, raised once to let handler run
+
+	ctx    context.Context // of the current Run
+	thread *Thread         // nil until current-thread is called
+
+	// nested calls from primitives, see Call
+	barrier int   // id of the innermost call, 0 outside of calls
+	outer   []int // ids of the calls it is nested in
+	calls   int   // number of calls made, for ids
+
+	tail *tailCall // requested by the running primitive
+}
+
+// returned from nested calls up to the one where k was made,
+// which continues with k
+type escape struct {
+	k     *Continuation
+	value LObj
+}
+
+func (e *escape) Error() string {
+	return "continuation: escaping from procedure called by primitive"
+}
+
+// procedure applied in place of primitive, see TailCall
+type tailCall struct {
+	proc LObj
+	args []LObj
 }
 
+// returned by Run when MaxSteps instructions have been executed
+var ErrBudgetExceeded = errors.New("step budget exceeded")
+
+// raised as catchable conditions when limits are exceeded
+var (
+	ErrStackExceeded = errors.New("stack limit exceeded")
+	ErrHeapExceeded  = errors.New("heap limit exceeded")
+)
+
+// allocation after the handler reserve is used up, not catchable
+var errHeapExhausted = fmt.Errorf("%w in handler", ErrHeapExceeded)
+
+// approximate sizes for MaxHeap
+const (
+	objSize     = int(unsafe.Sizeof(LObj{}))
+	frameSize   = int(unsafe.Sizeof(Frame{}))
+	heapReserve = 64 * objSize // extra bytes for handler
+	maxAlloc    = 1 << 30      // bytes made by one primitive, even without MaxHeap
+)
+
+// how often RunContext checks cancellation
+const cancelCheckInterval = 1024
+
 func NewVM() *VM {
 	vm := &VM{
-		a: LispNull,
-		x: LispNull,
-		e: LispNull,
-		r: LispNull,
-		s: LispNull,
-	}
-	// vars := NewList(*NewSymbol("+"), *NewSymbol("-"))
-	// vals := NewList(
-	// 	LObj{
-	// 		Type: DTPrimitive,
-	// 		Value: func(args ...LObj) LObj {
-	// 			ret := 0
-	// 			for _, elem := range args {
-	// 				ret += elem.Value.(int)
-	// 			}
-	// 			return LObj{
-	// 				Type:  DTNumber,
-	// 				Value: ret,
-	// 			}
-	// 		}},
-	// 	LObj{
-	// 		Type: DTPrimitive,
-	// 		Value: func(args ...LObj) LObj {
-	// 			var ret int = 0
-	// 			if len(args) == 1 {
-	// 				ret = -args[0].Value.(int)
-	// 			} else {
-	// 				ret = args[0].Value.(int)
-	// 				args = args[1:len(args)]
-	// 				for _, elem := range args {
-	// 					ret -= elem.Value.(int)
-	// 				}
-	// 			}
-	// 			return LObj{
-	// 				Type:  DTNumber,
-	// 				Value: ret,
-	// 			}
-	// 		},
-	// 	},
-	// )
-	// vm.e = vm.e.Extend(vars, vals)
+		a:     LispNull,
+		stack: make([]LObj, 0, 1024),
+	}
 	return vm
 }
 
-func (vm *VM) Load(obj LObj) {
-	vm.x = obj
+func (vm *VM) Load(code *Code) {
+	vm.code = code
+	vm.pc = 0
+	vm.f = 0
+	vm.c = nil
+	vm.stack = vm.stack[:0]
+	vm.frames = vm.frames[:0]
+	vm.handlers = vm.handlers[:0]
 }
 
 func (vm VM) String() string {
-	return fmt.Sprintf("a: %v\nx: %v\ne: %v\nr: %v\ns: %v\n", vm.a, vm.x, vm.e, vm.r, vm.s)
+	return fmt.Sprintf("a: %v\nx: %s\nf: %d\nc: %v\ns: %v\n",
+		vm.a, vm.code.Instruction(vm.pc), vm.f, vm.c, vm.stack)
+}
+
+// fetch operand
+func (vm *VM) operand() int {
+	arg := vm.code.Ops[vm.pc]
+	vm.pc += 1
+	return arg
+}
+
+func (vm *VM) push(obj LObj) {
+	vm.stack = append(vm.stack, obj)
+}
+
+// i th argument of current frame
+func (vm *VM) local(i int) *LObj {
+	return &vm.stack[vm.f-i-1]
+}
+
+// RuntimeError is error in Run with the call chain at that time
+type RuntimeError struct {
+	Err   error
+	Trace []TraceFrame // innermost first
+}
+
+func (e *RuntimeError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Err.Error())
+	for _, frame := range e.Trace {
+		fmt.Fprintf(&b, "\n  in %v", frame)
+	}
+	return b.String()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
 }
 
 func (vm *VM) Run() (LObj, error) {
-	// TODO: errorcheck
+	return vm.RunContext(context.Background())
+}
+
+// Run which stops with ctx.Err() when ctx is done
+func (vm *VM) RunContext(ctx context.Context) (LObj, error) {
+	vm.ctx = ctx
+	vm.steps = 0
+	vm.alloc = 0
+	vm.heapLimit = vm.MaxHeap
+	for {
+		ret, err := vm.run(ctx)
+		if err == nil {
+			return ret, nil
+		}
+		if err = vm.resumeEscape(err); err == nil || vm.handle(err) {
+			continue
+		}
+		trace := vm.Backtrace()
+		// pc is after the failed instruction
+		trace[0] = newTraceFrame(vm.code, vm.pc-1)
+		return ret, &RuntimeError{Err: err, Trace: trace}
+	}
+}
+
+// pass err to the innermost handler, false if not caught
+func (vm *VM) handle(err error) bool {
+	if len(vm.handlers) == 0 || !catchable(err) {
+		return false
+	}
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	vm.stack = vm.stack[:h.s]
+	vm.frames = vm.frames[:h.frames]
+	vm.code = h.code
+	vm.pc = h.pc
+	vm.f = h.f
+	vm.c = h.c
+	vm.a = conditionObject(err)
+	return true
+}
+
+// errors which stop untrusted code regardless of handlers
+func catchable(err error) bool {
+	var esc *escape
+	return !(errors.Is(err, ErrBudgetExceeded) || err == errHeapExhausted ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &esc))
+}
+
+// continue with the continuation if err escapes to the current call,
+// nil if it is done
+func (vm *VM) resumeEscape(err error) error {
+	var esc *escape
+	if !errors.As(err, &esc) || esc.k.barrier != vm.barrier {
+		return err
+	}
+	return vm.resume(esc.k, esc.value)
+}
 
+// call k with v, on the call where it was made
+func (vm *VM) resume(k *Continuation, v LObj) error {
+	vm.a = v
+	// restore stack, then return to where it was captured
+	vm.stack = append(vm.stack[:0], k.stack...)
+	vm.frames = append(vm.frames[:0], k.frames...)
+	vm.handlers = append(vm.handlers[:0], k.handlers...)
+	return vm.Return(0)
+}
+
+// whether call id is running, 0 is the Run itself
+func (vm *VM) active(id int) bool {
+	if id == vm.barrier {
+		return true
+	}
+	for _, outer := range vm.outer {
+		if outer == id {
+			return true
+		}
+	}
+	return false
+}
+
+// count n bytes of allocation against MaxHeap
+func (vm *VM) charge(n int) error {
+	if vm.MaxHeap <= 0 {
+		return nil
+	}
+	vm.alloc += n
+	if vm.alloc <= vm.heapLimit {
+		return nil
+	}
+	if vm.heapLimit > vm.MaxHeap {
+		return errHeapExhausted
+	}
+	vm.heapLimit = vm.alloc + heapReserve
+	return ErrHeapExceeded
+}
+
+func (vm *VM) run(ctx context.Context) (LObj, error) {
+	done := ctx.Done()
 	for {
-		fmt.Println(vm)
-		switch vm.x.Car.String() {
-		case "halt": // (halt)
+		vm.steps += 1
+		if vm.MaxSteps > 0 && vm.steps > vm.MaxSteps {
+			return LispFalse, ErrBudgetExceeded
+		}
+		if done != nil && vm.steps%cancelCheckInterval == 0 {
+			select {
+			case <-done:
+				return LispFalse, ctx.Err()
+			default:
+			}
+		}
+		if vm.Tracer != nil {
+			vm.Tracer.OnInstruction(vm.code.Ops[vm.pc], vm)
+		}
+		op := vm.operand()
+		switch op {
+		case OpHalt: // (halt)
 			// finish computation, return value
 			ret := vm.a
 			// clear vm.a
 			vm.a = LispNull
 			return ret, nil
-		case "refer": // (refer var next-x)
-			// get variable name
-			varsym, _ := vm.x.ListRef(1)
-			// set x to next-x
-			vm.x, _ = vm.x.ListRef(2)
-			// set accumulator to variable's value
-			vals, err := vm.e.LookUp(&varsym)
-			if err != nil {
-				return *vals, err
+		case OpReferLocal: // (refer-local n)
+			vm.a = *vm.local(vm.operand())
+		case OpReferFree: // (refer-free n)
+			vm.a = vm.c.Free[vm.operand()]
+		case OpReferGlobal: // (refer-global g)
+			g := vm.code.Globals[vm.operand()]
+			val, ok := g.Value()
+			if !ok {
+				return LispFalse, fmt.Errorf("unbound variable: %v", *g.Symbol)
 			}
-			vm.a, err = vals.SafeCar()
-			if err != nil {
-				return vm.a, err
-			}
-		case "constant": // (constant obj next-x)
-			//  set! accumulator constant value
-			vm.a, _ = vm.x.ListRef(1)
-			// set x to next
-			vm.x, _ = vm.x.ListRef(2)
-		case "close": // (close body next-x)
-			// get lambda body
-			body, _ := vm.x.ListRef(1)
-			// set x to next-x
-			vm.x, _ = vm.x.ListRef(2)
-			// set accumulator to closure
-			vm.a = NewClosure(body, vm.e)
-		case "test": // (test then else)
-			thenobj, _ := vm.x.ListRef(1)
-			elseobj, _ := vm.x.ListRef(2)
-			// if accumulator is true
-			if vm.a.ToBool() {
-				vm.x = thenobj
-			} else {
-				vm.x = elseobj
-			}
-		case "assign": // (assign var next-x)
-			varsym, _ := vm.x.ListRef(1)
-			// set x to next-x
-			vm.x, _ = vm.x.ListRef(2)
-			vals, err := vm.e.LookUp(&varsym)
-			if err != nil {
-				return *vals, err
-			}
-			// assing var to value
-			vals.SetCar(vm.a)
-		case "conti": // (conti x)
-			// later, x takes one argument from accumulater
-			vm.x, _ = vm.x.ListRef(1)
-			// make continuation from stack
-			vm.a = NewContinuation(vm.s)
-		case "naute": // (naute s var)
-			// restore s
-			vm.s, _ = vm.x.ListRef(1)
-			// set accumulator to var's value
-			varsym, _ := vm.x.ListRef(2)
-			vals, err := vm.e.LookUp(&varsym)
-			if err != nil {
-				return *vals, err
+			vm.a = val
+		case OpIndirect: // (indirect)
+			// unbox
+			vm.a = *vm.a.Car
+		case OpConstant: // (constant k)
+			vm.a = vm.code.Consts[vm.operand()]
+		case OpClose: // (close nfree proto)
+			n := vm.operand()
+			proto := vm.code.Protos[vm.operand()]
+			if err := vm.charge(n*objSize + objSize); err != nil {
+				return LispFalse, err
 			}
-			vm.a, err = vals.SafeCar()
-			if err != nil {
-				return vm.a, err
-			}
-			// next is (return)
-			vm.x = NewList(*NewSymbol("return"))
-		case "frame": // (frame ret next-x)
-			ret, _ := vm.x.ListRef(1)
-			// set x to next-x
-			vm.x, _ = vm.x.ListRef(2)
-			vm.s = NewCallFrame(ret, vm.e, vm.r, vm.s)
-			vm.r = LispNull
-		case "argument": // (argument x)
-			vm.x, _ = vm.x.ListRef(1)
-			vm.r = Cons(vm.a, vm.r)
-		case "apply": // (apply)
-			// accumulator is closure or primitive
-			if vm.a.IsClosure() {
-				body := vm.a.Body()
-				e := vm.a.Env()
-				// next inst is body
-				vm.x = body // body's cont is (return)
-				// extend env with arguments
-				vm.e = e.Extend(vm.r)
-				vm.r = LispNull
-			} else if vm.a.IsPrimitive() {
-				vm.a = vm.a.PrimitiveApply(vm.r)
-				vm.r = LispNull
-				vm.x = NewList(*NewSymbol("return"))
-			} else {
-				return LispFalse, fmt.Errorf("not procedure: %v", vm.a)
-			}
-		case "return":
-			// resets from stack
-			vm.x, _ = vm.s.ListRef(0)
-			vm.e, _ = vm.s.ListRef(1)
-			vm.r, _ = vm.s.ListRef(2)
-			vm.s, _ = vm.s.ListRef(3)
+			// free variables are on the stack
+			s := len(vm.stack) - n
+			vm.a = NewClosure(proto, vm.stack[s:])
+			vm.stack = vm.stack[:s]
+		case OpBox: // (box n)
+			if err := vm.charge(objSize); err != nil {
+				return LispFalse, err
+			}
+			arg := vm.local(vm.operand())
+			*arg = NewBox(*arg)
+		case OpTest: // (test else-offset)
+			offset := vm.operand()
+			// if accumulator is false, jump to else
+			if !vm.a.ToBool() {
+				vm.pc += offset
+			}
+		case OpJump: // (jump offset)
+			offset := vm.operand()
+			vm.pc += offset
+		case OpAssignLocal: // (assign-local n)
+			*vm.local(vm.operand()).Car = vm.a
+		case OpAssignFree: // (assign-free n)
+			*vm.c.Free[vm.operand()].Car = vm.a
+		case OpAssignGlobal: // (assign-global g)
+			g := vm.code.Globals[vm.operand()]
+			if _, ok := g.Value(); !ok {
+				return LispFalse, fmt.Errorf("unbound variable: %v", *g.Symbol)
+			}
+			g.Set(vm.a)
+		case OpDefine: // (define g)
+			g := vm.code.Globals[vm.operand()]
+			g.Set(vm.a)
+			vm.a = *g.Symbol
+		case OpConti: // (conti drop)
+			// make continuation from stack without current arguments
+			n := vm.operand()
+			s := len(vm.stack) - n
+			if err := vm.charge(s*objSize + len(vm.frames)*frameSize); err != nil {
+				return LispFalse, err
+			}
+			vm.a = NewContinuation(vm, vm.stack[:s], vm.frames, vm.handlers)
+			vm.a.Value.(*Continuation).barrier = vm.barrier
+		case OpFrame: // (frame return-offset)
+			offset := vm.operand()
+			if vm.MaxDepth > 0 && len(vm.frames) >= vm.MaxDepth {
+				return LispFalse, ErrStackExceeded
+			}
+			vm.frames = append(vm.frames, Frame{code: vm.code, pc: vm.pc + offset, f: vm.f, c: vm.c})
+		case OpArgument: // (argument)
+			if vm.MaxStack > 0 && len(vm.stack) >= vm.MaxStack {
+				return LispFalse, ErrStackExceeded
+			}
+			vm.push(vm.a)
+		case OpShift: // (shift argc drop)
+			// move new arguments over current frame's ones
+			n := vm.operand()
+			m := vm.operand()
+			s := len(vm.stack)
+			copy(vm.stack[s-n-m:], vm.stack[s-n:])
+			vm.stack = vm.stack[:s-m]
+		case OpApply: // (apply argc)
+			if err := vm.apply(vm.operand()); err != nil {
+				return LispFalse, err
+			}
+		case OpReturn: // (return drop)
+			if err := vm.Return(vm.operand()); err != nil {
+				return LispFalse, err
+			}
+		case OpHandler: // (handler offset)
+			// handler continues at offset with current stack and frames
+			offset := vm.operand()
+			vm.handlers = append(vm.handlers, handler{
+				code: vm.code, pc: vm.pc + offset, f: vm.f, c: vm.c,
+				s: len(vm.stack), frames: len(vm.frames),
+			})
+		case OpUnhandler: // (unhandler)
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+		default:
+			return LispFalse, fmt.Errorf("unknown instruction: %d", op)
 		}
 	}
 }
 
-// VM support functions
-//
-// environment
-func (env *LObj) LookUp(access *LObj) (*LObj, error) {
-	for e, rib := env, access.Car.Value.(int); ; e, rib = e.Cdr, rib-1 {
-		if e.IsNull() {
-			return e, fmt.Errorf("unbound variable: %v", access)
+// apply accumulator to argc arguments on the stack
+func (vm *VM) apply(argc int) error {
+	for {
+		if vm.Tracer != nil {
+			vm.Tracer.OnCall(vm.a, vm.args(argc), vm)
 		}
-		if rib == 0 {
-			for r, elt := e.Car, access.Cdr.Value.(int); ; r, elt = r.Cdr, elt-1 {
-				if elt == 0 {
-					return r, nil
+		// accumulator is closure, primitive or continuation
+		switch vm.a.Type {
+		case DTClosure:
+			closure := vm.a.Value.(*Closure)
+			if argc != closure.Code.Arity {
+				return fmt.Errorf("%v: wrong number of arguments: %d for %d",
+					vm.a, argc, closure.Code.Arity)
+			}
+			// next inst is body
+			vm.code = closure.Code
+			vm.pc = 0
+			vm.f = len(vm.stack)
+			vm.c = closure
+		case DTPrimitive:
+			args := vm.args(argc)
+			if cost := vm.a.Value.(*Primitive).Cost; cost != nil {
+				if err := vm.charge(cost(args)); err != nil {
+					return err
 				}
 			}
+			ret, err := vm.applyPrimitive(vm.a.Value.(*Primitive), args)
+			if err != nil {
+				vm.tail = nil
+				return err
+			}
+			if tail := vm.tail; tail != nil {
+				// replace arguments, apply again with the same frame
+				vm.tail = nil
+				vm.stack = vm.stack[:len(vm.stack)-argc]
+				if vm.MaxStack > 0 && len(vm.stack)+len(tail.args) > vm.MaxStack {
+					return ErrStackExceeded
+				}
+				for i := len(tail.args) - 1; i >= 0; i-- {
+					vm.push(tail.args[i])
+				}
+				vm.a = tail.proc
+				argc = len(tail.args)
+				continue
+			}
+			vm.a = ret
+			return vm.Return(argc)
+		case DTContinuation:
+			if argc != 1 {
+				return fmt.Errorf("continuation: wrong number of arguments: %d", argc)
+			}
+			k := vm.a.Value.(*Continuation)
+			if k.vm != vm {
+				return fmt.Errorf("continuation: called from another thread")
+			}
+			if !vm.active(k.barrier) {
+				return fmt.Errorf("continuation: called after procedure called by primitive returned")
+			}
+			if k.barrier != vm.barrier { // unwind nested calls
+				return &escape{k: k, value: vm.stack[len(vm.stack)-1]}
+			}
+			return vm.resume(k, vm.stack[len(vm.stack)-1])
+		default:
+			return fmt.Errorf("not procedure: %v", vm.a)
 		}
+		return nil
 	}
 }
 
-// func (env *LObj) Extend(vars, vals LObj) LObj {
-// 	return Cons(Cons(vars, vals), *env)
-// }
+// top n arguments, the first one is on the top
+func (vm *VM) args(n int) []LObj {
+	args := make([]LObj, n)
+	s := len(vm.stack)
+	for i := range args {
+		args[i] = vm.stack[s-i-1]
+	}
+	return args
+}
 
-// closure
-func NewClosure(body, env LObj) LObj {
-	return LObj{
-		Type: DTClosure,
-		Car:  &env,
-		Cdr:  &body,
+// drop n arguments and resets registers from frame
+func (vm *VM) Return(n int) error {
+	vm.stack = vm.stack[:len(vm.stack)-n]
+	if len(vm.frames) == 0 {
+		return fmt.Errorf("return: empty stack")
 	}
+	frame := vm.frames[len(vm.frames)-1]
+	vm.frames = vm.frames[:len(vm.frames)-1]
+	vm.code = frame.code
+	vm.pc = frame.pc
+	vm.f = frame.f
+	vm.c = frame.c
+	if vm.Tracer != nil {
+		vm.Tracer.OnReturn(vm.a, vm)
+	}
+	return nil
+}
+
+// closure
+// display closure holds values of free variables
+type Closure struct {
+	Code *Code
+	Free []LObj
 }
 
-func (closure *LObj) Body() LObj {
-	return *closure.Cdr
+func NewClosure(code *Code, free []LObj) LObj {
+	closure := &Closure{Code: code, Free: make([]LObj, len(free))}
+	copy(closure.Free, free)
+	return LObj{Type: DTClosure, Value: closure}
 }
-func (closure *LObj) Env() LObj {
-	return *closure.Car
+
+func (closure *Closure) String() string {
+	return fmt.Sprintf("<closure %s>", closure.Code.name())
+}
+
+// box for assigned variable
+func NewBox(obj LObj) LObj {
+	return LObj{Type: DTBox, Car: &obj}
 }
 
 // continuation
-func NewContinuation(s LObj) LObj {
-	// (closure (naute s (0 . 0)) ())
-	zero := LObj{Type: DTNumber, Value: 0}
-	body := NewList(*NewSymbol("naute"), s, Cons(zero, zero))
-	env := LispNull
-	return NewClosure(body, env)
+// copy of the stack, call frames and handlers
+// it can be called only on the VM which made it, in the same nested call
+// or in calls nested in it to escape from them.
+type Continuation struct {
+	vm       *VM
+	barrier  int
+	stack    []LObj
+	frames   []Frame
+	handlers []handler
+}
+
+func NewContinuation(vm *VM, stack []LObj, frames []Frame, handlers []handler) LObj {
+	k := &Continuation{
+		vm:       vm,
+		stack:    make([]LObj, len(stack)),
+		frames:   make([]Frame, len(frames)),
+		handlers: make([]handler, len(handlers)),
+	}
+	copy(k.stack, stack)
+	copy(k.frames, frames)
+	copy(k.handlers, handlers)
+	return LObj{Type: DTContinuation, Value: k}
 }
 
 // call frame
-func NewCallFrame(x, e, r, s LObj) LObj {
-	return NewList(x, e, r, s)
+type Frame struct {
+	code *Code // return address
+	pc   int
+	f    int      // saved frame pointer
+	c    *Closure // saved closure
+}
+
+// exception handler installed by guard
+// registers and lengths of stack and frames to restore
+type handler struct {
+	code   *Code
+	pc     int
+	f      int
+	c      *Closure
+	s      int
+	frames int
+}
+
+// apply primitive outside of VM
+func (obj *LObj) PrimitiveApply(args []LObj) (LObj, error) {
+	return (*VM)(nil).applyPrimitive(obj.Value.(*Primitive), args)
+}
+
+// VM-aware primitive runs on a new VM if vm is nil
+func (vm *VM) applyPrimitive(prim *Primitive, args []LObj) (LObj, error) {
+	if len(args) < prim.Min || (prim.Max >= 0 && len(args) > prim.Max) {
+		return LispFalse, fmt.Errorf("%s: wrong number of arguments: %d", prim.Name, len(args))
+	}
+	if prim.VMFn != nil {
+		if vm == nil {
+			return NewVM().Apply(LObj{Type: DTPrimitive, Value: prim}, args...)
+		}
+		return prim.VMFn(vm, args...)
+	}
+	return prim.Fn(args...)
+}
+
+// context of the current Run, for blocking primitives
+func (vm *VM) Context() context.Context {
+	if vm.ctx == nil {
+		return context.Background()
+	}
+	return vm.ctx
+}
+
+// apply proc to args, running until it returns
+func (vm *VM) Apply(proc LObj, args ...LObj) (LObj, error) {
+	return vm.ApplyContext(context.Background(), proc, args...)
+}
+
+func (vm *VM) ApplyContext(ctx context.Context, proc LObj, args ...LObj) (LObj, error) {
+	vm.Load(applyCode(DefaultEnvironment, proc, args))
+	return vm.RunContext(ctx)
+}
+
+// Call applies proc from a VM-aware primitive running on vm.
+// proc runs in a nested loop until it returns, with the limits of the Run.
+// its errors which are not caught by handlers inside are returned,
+// continuations made outside escape from it by an error returned here
+// which the primitive must return, and continuations made inside
+// can not be called after it returns.
+func (vm *VM) Call(proc LObj, args ...LObj) (LObj, error) {
+	// globals are looked up where the primitive is called, e.g. by the debugger
+	return vm.callCode(applyCode(vm.code.environment, proc, args))
 }
 
-func (obj *LObj) PrimitiveApply(arglist LObj) LObj {
-	args := make([]LObj, 0)
+// run code ending with OpHalt nested in the current Run, see Call
+func (vm *VM) callCode(next *Code) (LObj, error) {
+	a, code, pc, f, c := vm.a, vm.code, vm.pc, vm.f, vm.c
+	s, frames, handlers := len(vm.stack), len(vm.frames), len(vm.handlers)
+	barrier := vm.barrier
+	vm.outer = append(vm.outer, barrier)
+	vm.calls++
+	vm.barrier = vm.calls
+	defer func() {
+		vm.a, vm.code, vm.pc, vm.f, vm.c = a, code, pc, f, c
+		vm.stack, vm.frames, vm.handlers = vm.stack[:s], vm.frames[:frames], vm.handlers[:handlers]
+		vm.barrier = barrier
+		vm.outer = vm.outer[:len(vm.outer)-1]
+	}()
+	vm.code, vm.pc, vm.f, vm.c = next, 0, len(vm.stack), nil
 	for {
-		if arglist.IsNull() {
-			break
+		ret, err := vm.run(vm.Context())
+		if err == nil {
+			return ret, nil
+		}
+		if err = vm.resumeEscape(err); err == nil || (len(vm.handlers) > handlers && vm.handle(err)) {
+			continue
 		}
-		elem, _ := arglist.Pop()
-		args = append(args, elem)
+		return LispFalse, err
+	}
+}
+
+// TailCall is returned by a VM-aware primitive to apply proc to args
+// in place of the primitive, as a tail call without growing the Go stack.
+//
+//	return vm.TailCall(proc, args...)
+func (vm *VM) TailCall(proc LObj, args ...LObj) (LObj, error) {
+	vm.tail = &tailCall{proc: proc, args: args}
+	return LispNull, nil
+}
+
+// code calling proc with constant arguments, in environment
+func applyCode(environment *Environment, proc LObj, args []LObj) *Code {
+	code := &Code{Name: "<apply>", Vars: LispNull, Free: LispNull, environment: environment}
+	framepos := code.emit(OpFrame, 0)
+	for i := len(args) - 1; i >= 0; i-- {
+		code.emit(OpConstant, code.constant(args[i]))
+		code.emit(OpArgument)
 	}
-	f := obj.Value.(func(...LObj) LObj)
-	return f(args...)
+	code.emit(OpConstant, code.constant(proc))
+	code.emit(OpApply, len(args))
+	code.patch(framepos)
+	code.emit(OpHalt)
+	return code
 }